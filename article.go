@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/html"
+)
+
+const (
+	maxArticles         = 5
+	articleFetchTimeout = 15 * time.Second
+	maxArticleBytes     = 2 << 20
+	// article text sent to the model, about 6k tokens
+	maxArticleChars = 24000
+)
+
+var (
+	errPrivateAddress = errors.New("article url points at a private address")
+	// the page did not change since prev was fetched
+	errNotModified = errors.New("article not modified")
+)
+
+// ranges that are not on the public internet but that netip has no Is method for
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier grade nat
+	netip.MustParsePrefix("192.0.0.0/24"),    // ietf protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // nat64, embeds an ipv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local nat64
+	netip.MustParsePrefix("100::/64"),        // discard only
+	netip.MustParsePrefix("2001::/23"),       // ietf protocol assignments, teredo among them
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, embeds an ipv4 address
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+}
+
+// publicAddress is false for anything an article fetch has no business reaching.
+func publicAddress(addr netip.Addr) bool {
+	// ::ffff:10.0.0.1 is 10.0.0.1
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// articleClient only talks to public addresses, the urls come straight from users. no proxy,
+// the dial check would see the proxy's address and not the article's.
+var articleClient = &http.Client{
+	Timeout: articleFetchTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			// checked on the resolved address, so a public name pointing inside doesnt get through either
+			Control: func(network, address string, c syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if !publicAddress(addrPort.Addr()) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// Article is the readable part of a fetched page.
+type Article struct {
+	URL   string
+	Title string
+	Text  string
+	// validators from the response, sent back when the article is revalidated
+	ETag         string
+	LastModified string
+}
+
+// articleSource is what the opening prompt gets for one article. Content is empty when the
+// article could not be fetched, the model only sees the url then.
+type articleSource struct {
+	URL     string
+	Title   string
+	Content string
+	// from the article analysis, empty when it failed
+	ProblemStatement string
+	Concepts         []string
+}
+
+// fetchArticle downloads and extracts url. with prev it asks for the page only if it changed,
+// and returns errNotModified when it didnt.
+func fetchArticle(ctx context.Context, url string, prev *Article) (*Article, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "sd-bro/1.0 (+system design interview practice)")
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9")
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := articleClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		return nil, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("article returned %s", resp.Status)
+	}
+
+	article := &Article{URL: url, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	body := io.LimitReader(resp.Body, maxArticleBytes)
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/plain", "text/markdown":
+		text, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		article.Text = truncateRunes(strings.TrimSpace(string(text)), maxArticleChars)
+	case "text/html", "application/xhtml+xml", "":
+		title, text, err := extractArticle(body)
+		if err != nil {
+			return nil, err
+		}
+		article.Title, article.Text = title, truncateRunes(text, maxArticleChars)
+	default:
+		return nil, fmt.Errorf("article is %s, not a page", mediaType)
+	}
+	return article, nil
+}
+
+// the parts of a page that are never the article
+var skippedElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "svg": true, "nav": true, "header": true,
+	"footer": true, "aside": true, "form": true, "button": true, "iframe": true, "template": true,
+}
+
+// elements that end a line of text
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "pre": true, "blockquote": true, "tr": true, "section": true, "article": true,
+}
+
+// extractArticle pulls the title and the visible text out of a page. no readability scoring,
+// dropping the page chrome is enough for the model to find the article in what is left.
+func extractArticle(r io.Reader) (title, text string, err error) {
+	z := html.NewTokenizer(r)
+	var b strings.Builder
+	skipping := 0
+	inTitle := false
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if errors.Is(z.Err(), io.EOF) {
+				return strings.Join(strings.Fields(title), " "), collapseLines(b.String()), nil
+			}
+			return "", "", z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch {
+			case skippedElements[tag]:
+				if tt == html.StartTagToken {
+					skipping++
+				}
+			case tag == "title" && skipping == 0:
+				inTitle = true
+			case blockElements[tag]:
+				b.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch {
+			case skippedElements[tag] && skipping > 0:
+				skipping--
+			case tag == "title":
+				inTitle = false
+			case blockElements[tag]:
+				b.WriteString("\n")
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+				continue
+			}
+			if skipping == 0 {
+				b.WriteString(strings.Join(strings.Fields(string(z.Text())), " "))
+				b.WriteString(" ")
+			}
+		}
+	}
+}
+
+func collapseLines(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+// gatherSources loads the session's articles at once, through the article cache. a single article goes
+// to the model as is, several are cut down to their cached summaries so together they still fit, or
+// condensed again with the topic as the focus when there is one. articles that cannot be fetched are
+// passed on as a bare url, like before fetching existed.
+func (cfg *config) gatherSources(ctx context.Context, session *ChatSession, urls []string, topic string) []articleSource {
+	ctx, span := startSpan(ctx, "gatherSources", attribute.Int("articles", len(urls)))
+	defer span.End()
+
+	sources := make([]articleSource, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		sources[i].URL = url
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cached, err := cfg.loadArticle(ctx, session, url)
+			if err != nil {
+				errorsTotal.WithLabelValues(causeArticleFetch).Inc()
+				slog.WarnContext(ctx, "failed to fetch article, the model only gets the url", "url", url, "error", err)
+				return
+			}
+			article := &cached.Article
+			sources[i].Title = article.Title
+			sources[i].Content = article.Text
+			sources[i].ProblemStatement = cached.ProblemStatement
+			sources[i].Concepts = cached.Concepts
+			if len(urls) == 1 || article.Text == "" {
+				return
+			}
+			if topic == "" && cached.Summary != "" {
+				sources[i].Content = cached.Summary
+				return
+			}
+			condensed, err := cfg.condenseArticle(ctx, session, article, topic)
+			if err != nil {
+				slog.WarnContext(ctx, "failed to condense article, sending the start of it instead", "url", url, "error", err)
+				sources[i].Content = truncateRunes(article.Text, maxArticleChars/len(urls))
+				return
+			}
+			sources[i].Content = condensed
+		}()
+	}
+	wg.Wait()
+	return sources
+}
+
+func (cfg *config) condenseArticle(ctx context.Context, session *ChatSession, article *Article, topic string) (string, error) {
+	focus := "the main system design problem it describes"
+	if topic != "" {
+		focus = "what it says about " + topic
+	}
+	turn := &genai.Content{
+		Parts: []genai.Part{genai.Text(fmt.Sprintf("Focus on %s.\n\nTitle: %s\n\n%s", focus, article.Title, article.Text))},
+		Role:  "user",
+	}
+	summary, usage, err := cfg.generate(ctx, getCondenseInstructions(), nil, turn)
+	if err != nil {
+		return "", err
+	}
+	recordUsage(session.UserID, session, tokenUsage(usage))
+	return summary, nil
+}
+
+func getCondenseInstructions() []genai.Part {
+	return []genai.Part{
+		genai.Text("You condense engineering blog posts for a system design interviewer who will read several of them and ask one question spanning all."),
+		genai.Text("Write at most 250 words of plain text: the problem the system solves, its scale, the main components, and the key trade-offs and decisions."),
+		genai.Text("Leave out marketing, hiring notes and anything unrelated to the system's design. No markdown, no asterisks."),
+	}
+}
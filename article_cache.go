@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"golang.org/x/sync/singleflight"
+)
+
+// query parameters that only say where the click came from
+var trackingParams = map[string]bool{"fbclid": true, "gclid": true, "ref": true, "mc_cid": true, "mc_eid": true}
+
+// articleCache keeps fetched and analyzed articles by normalized url, so a popular article is
+// downloaded and sent to the model for analysis once instead of on every /start. entries older
+// than ttl are revalidated with the page's ETag and Last-Modified before they are used again.
+type articleCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// cachedArticle is never changed once it is in the cache, loadArticle puts a new copy instead.
+type cachedArticle struct {
+	Article
+	// sha256 of the extracted title and text, a page that comes back the same keeps its analysis
+	Hash             string
+	ProblemStatement string
+	Concepts         []string
+	Summary          string
+
+	key       string
+	analyzed  bool
+	checkedAt time.Time
+}
+
+// articleLoad is what one shared load hands to every /start waiting on it.
+type articleLoad struct {
+	entry *cachedArticle
+	// tokens the analysis took, if this load ran one
+	usage Usage
+}
+
+type articleAnalysis struct {
+	ProblemStatement string
+	Concepts         []string
+	Summary          string
+}
+
+// newArticleCache returns nil when maxEntries is 0, a nil cache misses every lookup.
+func newArticleCache(maxEntries int, ttl time.Duration) *articleCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+	return &articleCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *articleCache) get(key string) *cachedArticle {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cachedArticle)
+}
+
+func (c *articleCache) put(entry *cachedArticle) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[entry.key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[entry.key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedArticle).key)
+	}
+}
+
+func (c *articleCache) fresh(entry *cachedArticle, now time.Time) bool {
+	return now.Sub(entry.checkedAt) < c.ttl
+}
+
+// normalizeArticleURL makes the links people paste for the same page match: scheme and host
+// lowercased, default port, fragment and tracking parameters dropped, query sorted. the path is
+// kept as it is, /post and /post/ can be different pages.
+func normalizeArticleURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+	u.Host = host
+	u.Fragment, u.RawFragment = "", ""
+	u.User = nil
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	query := u.Query()
+	for name := range query {
+		if strings.HasPrefix(strings.ToLower(name), "utm_") || trackingParams[strings.ToLower(name)] {
+			query.Del(name)
+		}
+	}
+	// Encode sorts by key
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func articleHash(a *Article) string {
+	h := sha256.New()
+	h.Write([]byte(a.Title))
+	h.Write([]byte{0x1f})
+	h.Write([]byte(a.Text))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// concurrent /starts on the same article share one fetch and one analysis
+var articleLoads singleflight.Group
+
+// loadArticle returns the article behind rawURL from the cache, revalidating or fetching it as needed,
+// and analyzes it if that has not worked yet. when a stale entry cannot be revalidated it is used as is.
+// every session that waited on an analysis is charged for it, same as if it had run it alone.
+func (cfg *config) loadArticle(ctx context.Context, session *ChatSession, rawURL string) (*cachedArticle, error) {
+	key := normalizeArticleURL(rawURL)
+	if cached := cfg.articleCache.get(key); cached != nil && cached.analyzed && cfg.articleCache.fresh(cached, time.Now()) {
+		articleCacheLookups.WithLabelValues("hit").Inc()
+		return cached, nil
+	}
+
+	v, err, shared := articleLoads.Do(key, func() (any, error) {
+		// the others waiting on it should not fail because the first one hung up
+		return cfg.refreshArticle(context.WithoutCancel(ctx), key, rawURL)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		articleCacheLookups.WithLabelValues("shared").Inc()
+	}
+	load := v.(articleLoad)
+	if load.usage != (Usage{}) {
+		recordUsage(session.UserID, session, load.usage)
+	}
+	return load.entry, nil
+}
+
+// refreshArticle does the fetching and analyzing for loadArticle, once per key at a time.
+func (cfg *config) refreshArticle(ctx context.Context, key, rawURL string) (articleLoad, error) {
+	now := time.Now()
+	cached := cfg.articleCache.get(key)
+
+	var entry cachedArticle
+	switch {
+	case cached != nil && cfg.articleCache.fresh(cached, now):
+		articleCacheLookups.WithLabelValues("hit").Inc()
+		if cached.analyzed {
+			return articleLoad{entry: cached}, nil
+		}
+		entry = *cached
+	default:
+		var prev *Article
+		if cached != nil {
+			prev = &cached.Article
+		}
+		article, err := fetchArticle(ctx, rawURL, prev)
+		switch {
+		case errors.Is(err, errNotModified):
+			articleCacheLookups.WithLabelValues("revalidated").Inc()
+			entry = *cached
+		case err != nil && cached != nil:
+			articleCacheLookups.WithLabelValues("stale").Inc()
+			slog.WarnContext(ctx, "failed to revalidate article, using the cached copy", "url", rawURL, "error", err)
+			return articleLoad{entry: cached}, nil
+		case err != nil:
+			articleCacheLookups.WithLabelValues("miss").Inc()
+			return articleLoad{}, err
+		default:
+			hash := articleHash(article)
+			if cached != nil && cached.Hash == hash {
+				// the server just doesnt do conditional requests, the analysis still holds
+				articleCacheLookups.WithLabelValues("revalidated").Inc()
+				entry = *cached
+				entry.Article = *article
+			} else {
+				if cached != nil {
+					articleCacheLookups.WithLabelValues("changed").Inc()
+				} else {
+					articleCacheLookups.WithLabelValues("miss").Inc()
+				}
+				entry = cachedArticle{Article: *article, Hash: hash, key: key}
+			}
+		}
+		entry.checkedAt = now
+	}
+
+	var usage Usage
+	if !entry.analyzed && entry.Text != "" {
+		var analysis articleAnalysis
+		var err error
+		analysis, usage, err = cfg.analyzeArticle(ctx, &entry.Article)
+		if err != nil {
+			// the article is still worth sending without it, the next /start tries again
+			slog.WarnContext(ctx, "failed to analyze article", "url", rawURL, "error", err)
+		} else {
+			entry.ProblemStatement = analysis.ProblemStatement
+			entry.Concepts = analysis.Concepts
+			entry.Summary = analysis.Summary
+			entry.analyzed = true
+		}
+	}
+	cfg.articleCache.put(&entry)
+	return articleLoad{entry: &entry, usage: usage}, nil
+}
+
+// analyzeArticle asks the model once per article for what every session on it needs: the problem
+// it solves, the concepts worth listening for, and a summary short enough to combine with others.
+// the tokens are returned rather than recorded, loadArticle charges them to each session that waited.
+func (cfg *config) analyzeArticle(ctx context.Context, article *Article) (articleAnalysis, Usage, error) {
+	turn := &genai.Content{
+		Parts: []genai.Part{genai.Text("Title: " + article.Title + "\n\n" + article.Text)},
+		Role:  "user",
+	}
+	reply, usage, err := cfg.generate(ctx, getAnalysisInstructions(), nil, turn)
+	if err != nil {
+		return articleAnalysis{}, Usage{}, err
+	}
+	return parseArticleAnalysis(reply), tokenUsage(usage), nil
+}
+
+func getAnalysisInstructions() []genai.Part {
+	return []genai.Part{
+		genai.Text("You prepare engineering blog posts for a system design interviewer."),
+		genai.Text("Answer in exactly this plain text format, no markdown:\nPROBLEM: the system design problem the article solves, in one sentence\nCONCEPTS: at most 10 technical terms and named technologies from the article, comma separated\nSUMMARY:\nat most 250 words on the problem, its scale, the main components, and the key trade-offs and decisions"),
+		genai.Text("If the article does not solve a system design problem, leave PROBLEM empty. Leave out marketing, hiring notes and anything unrelated to the system's design."),
+	}
+}
+
+func parseArticleAnalysis(reply string) articleAnalysis {
+	var a articleAnalysis
+	var summary []string
+	inSummary := false
+	for _, line := range strings.Split(reply, "\n") {
+		// models add bold to the labels now and then
+		label, rest, found := strings.Cut(strings.Trim(line, "*# "), ":")
+		label = strings.ToUpper(strings.Trim(label, "* "))
+		rest = strings.TrimSpace(strings.TrimLeft(rest, "*"))
+		switch {
+		case !inSummary && found && label == "PROBLEM":
+			a.ProblemStatement = rest
+		case !inSummary && found && label == "CONCEPTS":
+			for _, c := range strings.Split(rest, ",") {
+				if c = strings.Trim(c, " ."); c != "" {
+					a.Concepts = append(a.Concepts, c)
+				}
+			}
+		case !inSummary && found && label == "SUMMARY":
+			inSummary = true
+			if rest != "" {
+				summary = append(summary, rest)
+			}
+		case inSummary:
+			summary = append(summary, line)
+		}
+	}
+	a.Summary = strings.TrimSpace(strings.Join(summary, "\n"))
+	return a
+}
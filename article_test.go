@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.215.14", true},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"192.0.0.8", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"::", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestArticleClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "internal")
+	}))
+	defer srv.Close()
+
+	// a proxy in the environment must not take the check out of the loop
+	t.Setenv("HTTP_PROXY", srv.URL)
+	_, err := fetchArticle(context.Background(), srv.URL, nil)
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("err = %v, want errPrivateAddress", err)
+	}
+}
+
+func TestExtractArticle(t *testing.T) {
+	page := `<html><head><title>Scaling
+	the feed</title><style>.a{}</style><script>var x = "<p>no</p>"</script></head>
+	<body><nav>Home</nav><svg><title>icon</title></svg>
+	<article><h1>How we scaled</h1><p>We use   a <b>queue</b>.</p><p>And shards.</p></article>
+	<footer>copyright</footer></body></html>`
+
+	title, text, err := extractArticle(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Scaling the feed" {
+		t.Errorf("title = %q", title)
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) != 3 || lines[0] != "How we scaled" || !strings.HasPrefix(lines[1], "We use a queue") || lines[2] != "And shards." {
+		t.Errorf("text = %q, want the three lines of the article", text)
+	}
+	for _, chrome := range []string{"Home", "icon", "copyright", "var x", ".a{}"} {
+		if strings.Contains(text, chrome) {
+			t.Errorf("text = %q, should not contain %q", text, chrome)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/speech/apiv1p1beta1/speechpb"
+)
+
+var errUnsupportedAudio = errors.New("unsupported audio format")
+
+// audioInput is an upload plus the recognition settings that match it.
+type audioInput struct {
+	data     []byte
+	format   string
+	encoding speechpb.RecognitionConfig_AudioEncoding
+	// 0 leaves it to google, which only works for formats with a header (wav, flac)
+	sampleRate int32
+	channels   int32
+	// 0 when the format doesnt tell us without decoding
+	duration time.Duration
+}
+
+// opus always decodes at 48k, whatever the input rate in the header says
+const opusSampleRate = 48000
+
+// prepareAudio works out what was uploaded from the magic bytes, falling back to the multipart
+// content type, and transcodes the formats google cannot read if ffmpeg is available.
+func (cfg *config) prepareAudio(ctx context.Context, data []byte, contentType string) (*audioInput, error) {
+	in, err := sniffAudio(data, contentType)
+	if err == nil {
+		return in, nil
+	}
+	if cfg.ffmpegPath == "" {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "transcoding audio upload", "contentType", contentType, "reason", err.Error())
+	flac, terr := transcodeToFlac(ctx, cfg.ffmpegPath, data)
+	if terr != nil {
+		slog.WarnContext(ctx, "failed to transcode audio", "error", terr)
+		return nil, fmt.Errorf("%w: could not transcode %s", errUnsupportedAudio, contentType)
+	}
+	return sniffAudio(flac, "audio/flac")
+}
+
+func sniffAudio(data []byte, contentType string) (*audioInput, error) {
+	switch {
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return sniffWav(data)
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return sniffFlac(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return sniffOgg(data)
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return sniffWebm(data)
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		// mp4/m4a from safari, aac isnt something google reads
+		return nil, fmt.Errorf("%w: mp4/aac", errUnsupportedAudio)
+	case bytes.HasPrefix(data, []byte("ID3")) || isMp3Frame(data):
+		return sniffMp3(data)
+	}
+
+	// headerless pcm can only be described by its content type, e.g. audio/l16; rate=16000; channels=1
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType == "audio/l16" {
+		rate, _ := strconv.Atoi(params["rate"])
+		channels, _ := strconv.Atoi(params["channels"])
+		if rate <= 0 {
+			return nil, fmt.Errorf("%w: audio/l16 without a rate", errUnsupportedAudio)
+		}
+		channels = max(channels, 1)
+		return &audioInput{
+			data:       data,
+			format:     "pcm",
+			encoding:   speechpb.RecognitionConfig_LINEAR16,
+			sampleRate: int32(rate),
+			channels:   int32(channels),
+			duration:   pcmDuration(len(data), rate, channels, 16),
+		}, nil
+	}
+	if mediaType == "" {
+		mediaType = "unknown"
+	}
+	return nil, fmt.Errorf("%w: %s", errUnsupportedAudio, mediaType)
+}
+
+func sniffWav(data []byte) (*audioInput, error) {
+	var in *audioInput
+	var bits int
+	// chunks after the 12 byte RIFF header, fmt comes before data but not always first
+	for off := 12; off+8 <= len(data); {
+		id := string(data[off : off+4])
+		size := int(binary.LittleEndian.Uint32(data[off+4 : off+8]))
+		body := off + 8
+
+		switch {
+		case id == "fmt " && body+16 <= len(data):
+			format := binary.LittleEndian.Uint16(data[body:])
+			channels := binary.LittleEndian.Uint16(data[body+2:])
+			rate := binary.LittleEndian.Uint32(data[body+4:])
+			bits = int(binary.LittleEndian.Uint16(data[body+14:]))
+			// WAVE_FORMAT_EXTENSIBLE keeps the real format in the first two bytes of its sub format guid
+			if format == 0xFFFE && body+26 <= len(data) {
+				format = binary.LittleEndian.Uint16(data[body+24:])
+			}
+
+			in = &audioInput{data: data, format: "wav", sampleRate: int32(rate), channels: int32(channels)}
+			switch {
+			case format == 1 && bits == 16:
+				in.encoding = speechpb.RecognitionConfig_LINEAR16
+			case format == 7:
+				in.encoding = speechpb.RecognitionConfig_MULAW
+			default:
+				return nil, fmt.Errorf("%w: wav format %d with %d bit samples", errUnsupportedAudio, format, bits)
+			}
+		case id == "data" && in != nil:
+			// recorders that stream the wav write the size as 0 or max, the rest of the file is the data then
+			if size == 0 || body+size > len(data) {
+				size = len(data) - body
+			}
+			in.duration = pcmDuration(size, int(in.sampleRate), int(in.channels), bits)
+			return in, nil
+		}
+		off = body + size + size%2
+	}
+	if in == nil {
+		return nil, fmt.Errorf("%w: wav without a fmt chunk", errUnsupportedAudio)
+	}
+	return in, nil
+}
+
+func pcmDuration(size, rate, channels, bits int) time.Duration {
+	bytesPerSecond := rate * channels * bits / 8
+	if bytesPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(bytesPerSecond) * float64(time.Second))
+}
+
+func sniffFlac(data []byte) (*audioInput, error) {
+	// STREAMINFO is always the first metadata block: 4 byte marker, 4 byte block header, then the info
+	const info = 8
+	if len(data) < info+18 {
+		return nil, fmt.Errorf("%w: truncated flac header", errUnsupportedAudio)
+	}
+	// 20 bits of sample rate, 3 bits of channels-1, starting at byte 10 of STREAMINFO
+	rate := uint32(data[info+10])<<12 | uint32(data[info+11])<<4 | uint32(data[info+12])>>4
+	channels := (data[info+12]>>1)&0x07 + 1
+	// then 5 bits of bits per sample and 36 bits of total samples, 0 if the encoder didnt know
+	samples := uint64(data[info+13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(data[info+14:]))
+
+	in := &audioInput{
+		data:       data,
+		format:     "flac",
+		encoding:   speechpb.RecognitionConfig_FLAC,
+		sampleRate: int32(rate),
+		channels:   int32(channels),
+	}
+	if rate > 0 {
+		in.duration = time.Duration(float64(samples) / float64(rate) * float64(time.Second))
+	}
+	return in, nil
+}
+
+func sniffOgg(data []byte) (*audioInput, error) {
+	// the identification header sits in the first page
+	head := bytes.Index(data[:min(len(data), 512)], []byte("OpusHead"))
+	if head < 0 || head+10 > len(data) {
+		return nil, fmt.Errorf("%w: ogg without opus", errUnsupportedAudio)
+	}
+	return &audioInput{
+		data:       data,
+		format:     "ogg",
+		encoding:   speechpb.RecognitionConfig_OGG_OPUS,
+		sampleRate: opusSampleRate,
+		channels:   int32(data[head+9]),
+	}, nil
+}
+
+func sniffWebm(data []byte) (*audioInput, error) {
+	header := data[:min(len(data), 4096)]
+	codec := bytes.Index(header, []byte("A_OPUS"))
+	if codec < 0 {
+		return nil, fmt.Errorf("%w: webm without opus", errUnsupportedAudio)
+	}
+
+	// browsers record stereo unless asked otherwise, which is what we assumed before reading the header
+	channels := int32(2)
+	// Channels element (0x9F) with a one byte size (0x81), somewhere in the audio track after the codec id
+	if i := bytes.Index(header[codec:], []byte{0x9F, 0x81}); i >= 0 && codec+i+2 < len(header) {
+		channels = int32(header[codec+i+2])
+	}
+	return &audioInput{
+		data:       data,
+		format:     "webm",
+		encoding:   speechpb.RecognitionConfig_WEBM_OPUS,
+		sampleRate: opusSampleRate,
+		channels:   channels,
+	}, nil
+}
+
+func isMp3Frame(data []byte) bool {
+	return len(data) >= 4 && data[0] == 0xFF && data[1]&0xE0 == 0xE0 && data[1]&0x06 != 0
+}
+
+// sample rates by mpeg version (2.5, reserved, 2, 1) and rate index
+var mp3SampleRates = [4][3]int32{
+	{11025, 12000, 8000},
+	{},
+	{22050, 24000, 16000},
+	{44100, 48000, 32000},
+}
+
+func sniffMp3(data []byte) (*audioInput, error) {
+	off := 0
+	if bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10 {
+		// tag size is syncsafe, 7 bits per byte
+		size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+		off = 10 + size
+	}
+	if off >= len(data) || !isMp3Frame(data[off:]) {
+		return nil, fmt.Errorf("%w: no mp3 frame after the id3 tag", errUnsupportedAudio)
+	}
+
+	version := (data[off+1] >> 3) & 0x03
+	rateIndex := (data[off+2] >> 2) & 0x03
+	if version == 1 || rateIndex == 3 {
+		return nil, fmt.Errorf("%w: bad mp3 frame header", errUnsupportedAudio)
+	}
+	channels := int32(2)
+	if data[off+3]>>6 == 3 {
+		channels = 1
+	}
+	return &audioInput{
+		data:       data,
+		format:     "mp3",
+		encoding:   speechpb.RecognitionConfig_MP3,
+		sampleRate: mp3SampleRates[version][rateIndex],
+		channels:   channels,
+	}, nil
+}
+
+// transcodeToFlac turns anything ffmpeg can read into 16k mono flac.
+func transcodeToFlac(ctx context.Context, ffmpegPath string, data []byte) ([]byte, error) {
+	// a file and not stdin, mp4 often has its index at the end and ffmpeg needs to seek to it
+	in, err := os.CreateTemp("", "stt-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(in.Name())
+	_, err = in.Write(data)
+	in.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-i", in.Name(),
+		"-ac", "1", "-ar", "16000", "-sample_fmt", "s16",
+		"-f", "flac", "pipe:1",
+	)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// ffmpegPath is FFMPEG_PATH, or ffmpeg from PATH. empty means no transcoding.
+func ffmpegPath() string {
+	if p := envString("FFMPEG_PATH", ""); p != "" {
+		return p
+	}
+	p, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return ""
+	}
+	return p
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/speech/apiv1p1beta1/speechpb"
+)
+
+// wavFile is a RIFF header, a fmt chunk and dataSize bytes of samples. extensible writes
+// WAVE_FORMAT_EXTENSIBLE with format as the sub format.
+func wavFile(format uint16, channels uint16, rate uint32, bits uint16, dataSize int, extensible bool) []byte {
+	var b bytes.Buffer
+	le := func(v any) { binary.Write(&b, binary.LittleEndian, v) }
+	b.WriteString("RIFF")
+	le(uint32(0))
+	b.WriteString("WAVE")
+	b.WriteString("fmt ")
+	if extensible {
+		le(uint32(40))
+		le(uint16(0xFFFE))
+	} else {
+		le(uint32(16))
+		le(format)
+	}
+	le(channels)
+	le(rate)
+	le(rate * uint32(channels) * uint32(bits) / 8)
+	le(channels * bits / 8)
+	le(bits)
+	if extensible {
+		le(uint16(22))
+		le(bits)
+		le(uint32(0))
+		le(format)
+		b.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71})
+	}
+	b.WriteString("data")
+	le(uint32(dataSize))
+	b.Write(make([]byte, dataSize))
+	return b.Bytes()
+}
+
+// flacFile is the marker and a STREAMINFO block.
+func flacFile(rate uint32, channels uint8, samples uint64) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(rate >> 12)
+	info[11] = byte(rate >> 4)
+	info[12] = byte(rate<<4) | (channels-1)<<1
+	info[13] = byte(15<<4) | byte(samples>>32)&0x0F
+	binary.BigEndian.PutUint32(info[14:], uint32(samples))
+	return append([]byte("fLaC\x00\x00\x00\x22"), info...)
+}
+
+func TestSniffAudio(t *testing.T) {
+	oggOpus := append([]byte("OggS\x00\x02"), make([]byte, 22)...)
+	oggOpus = append(oggOpus, []byte("OpusHead\x01\x01\x38\x01")...)
+	webmHead := []byte{0x1A, 0x45, 0xDF, 0xA3}
+	webm := func(rest ...byte) []byte { return append(append(slices.Clone(webmHead), "....A_OPUS.."...), rest...) }
+	// mpeg 1 layer 3, 44.1k, stereo or mono
+	mp3Stereo := []byte{0xFF, 0xFB, 0x90, 0x00}
+	mp3Mono := []byte{0xFF, 0xFB, 0x90, 0xC0}
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x02\x00\x00"), mp3Mono...)
+
+	tests := []struct {
+		name         string
+		data         []byte
+		contentType  string
+		wantFormat   string
+		wantEncoding speechpb.RecognitionConfig_AudioEncoding
+		wantRate     int32
+		wantChannels int32
+		wantDuration time.Duration
+		wantErr      bool
+	}{
+		{name: "wav pcm", data: wavFile(1, 1, 16000, 16, 32000, false), wantFormat: "wav", wantEncoding: speechpb.RecognitionConfig_LINEAR16, wantRate: 16000, wantChannels: 1, wantDuration: time.Second},
+		{name: "wav extensible pcm", data: wavFile(1, 2, 48000, 16, 192000, true), wantFormat: "wav", wantEncoding: speechpb.RecognitionConfig_LINEAR16, wantRate: 48000, wantChannels: 2, wantDuration: time.Second},
+		{name: "wav mulaw", data: wavFile(7, 1, 8000, 8, 4000, false), wantFormat: "wav", wantEncoding: speechpb.RecognitionConfig_MULAW, wantRate: 8000, wantChannels: 1, wantDuration: 500 * time.Millisecond},
+		{name: "wav float", data: wavFile(3, 1, 16000, 32, 100, false), wantErr: true},
+		{name: "wav extensible float", data: wavFile(3, 1, 16000, 32, 100, true), wantErr: true},
+		{name: "wav 24 bit", data: wavFile(1, 1, 16000, 24, 100, false), wantErr: true},
+		// a streamed wav has no size for its data yet
+		{name: "wav data size unknown", data: func() []byte {
+			w := wavFile(1, 1, 16000, 16, 16000, false)
+			binary.LittleEndian.PutUint32(w[40:], 0xFFFFFFFF)
+			return w
+		}(), wantFormat: "wav", wantEncoding: speechpb.RecognitionConfig_LINEAR16, wantRate: 16000, wantChannels: 1, wantDuration: 500 * time.Millisecond},
+		{name: "wav without fmt", data: []byte("RIFF\x00\x00\x00\x00WAVEdata\x00\x00\x00\x00"), wantErr: true},
+		{name: "wav header only", data: []byte("RIFF\x00\x00\x00\x00WAVE"), wantErr: true},
+		{name: "wav truncated fmt", data: wavFile(1, 1, 16000, 16, 0, false)[:30], wantErr: true},
+		{name: "wav huge chunk size", data: []byte("RIFF\x00\x00\x00\x00WAVEjunk\xff\xff\xff\xff"), wantErr: true},
+
+		{name: "flac", data: flacFile(16000, 1, 48000), wantFormat: "flac", wantEncoding: speechpb.RecognitionConfig_FLAC, wantRate: 16000, wantChannels: 1, wantDuration: 3 * time.Second},
+		{name: "flac unknown length", data: flacFile(44100, 2, 0), wantFormat: "flac", wantEncoding: speechpb.RecognitionConfig_FLAC, wantRate: 44100, wantChannels: 2},
+		{name: "flac zero rate", data: flacFile(0, 1, 1000), wantFormat: "flac", wantEncoding: speechpb.RecognitionConfig_FLAC, wantChannels: 1},
+		{name: "flac truncated", data: flacFile(16000, 1, 1)[:20], wantErr: true},
+		{name: "flac marker only", data: []byte("fLaC"), wantErr: true},
+
+		{name: "ogg opus", data: oggOpus, wantFormat: "ogg", wantEncoding: speechpb.RecognitionConfig_OGG_OPUS, wantRate: 48000, wantChannels: 1},
+		{name: "ogg vorbis", data: append([]byte("OggS"), "\x01vorbis"...), wantErr: true},
+		{name: "ogg opus head cut off", data: oggOpus[:len(oggOpus)-3], wantErr: true},
+		{name: "ogg marker only", data: []byte("OggS"), wantErr: true},
+
+		{name: "webm opus mono", data: webm(0x9F, 0x81, 0x01), wantFormat: "webm", wantEncoding: speechpb.RecognitionConfig_WEBM_OPUS, wantRate: 48000, wantChannels: 1},
+		{name: "webm without channels", data: webm(), wantFormat: "webm", wantEncoding: speechpb.RecognitionConfig_WEBM_OPUS, wantRate: 48000, wantChannels: 2},
+		{name: "webm channels cut off", data: webm(0x9F, 0x81), wantFormat: "webm", wantEncoding: speechpb.RecognitionConfig_WEBM_OPUS, wantRate: 48000, wantChannels: 2},
+		{name: "webm vorbis", data: append(slices.Clone(webmHead), "A_VORBIS"...), wantErr: true},
+		{name: "webm marker only", data: webmHead, wantErr: true},
+
+		{name: "mp3", data: mp3Stereo, wantFormat: "mp3", wantEncoding: speechpb.RecognitionConfig_MP3, wantRate: 44100, wantChannels: 2},
+		{name: "mp3 after id3", data: id3, wantFormat: "mp3", wantEncoding: speechpb.RecognitionConfig_MP3, wantRate: 44100, wantChannels: 1},
+		{name: "id3 tag longer than the file", data: []byte("ID3\x04\x00\x00\x7f\x7f\x7f\x7f"), wantErr: true},
+		{name: "id3 truncated", data: []byte("ID3"), wantErr: true},
+		{name: "mp3 reserved version", data: []byte{0xFF, 0xEB, 0x90, 0x00}, wantErr: true},
+		{name: "mp3 reserved rate", data: []byte{0xFF, 0xFB, 0x9C, 0x00}, wantErr: true},
+
+		{name: "m4a", data: []byte("\x00\x00\x00\x20ftypM4A "), wantErr: true},
+
+		{name: "l16", data: make([]byte, 32000), contentType: "audio/L16; rate=16000; channels=1", wantFormat: "pcm", wantEncoding: speechpb.RecognitionConfig_LINEAR16, wantRate: 16000, wantChannels: 1, wantDuration: time.Second},
+		{name: "l16 channels default to mono", data: make([]byte, 16000), contentType: "audio/l16; rate=8000", wantFormat: "pcm", wantEncoding: speechpb.RecognitionConfig_LINEAR16, wantRate: 8000, wantChannels: 1, wantDuration: time.Second},
+		{name: "l16 without rate", data: make([]byte, 10), contentType: "audio/l16", wantErr: true},
+		{name: "l16 negative rate", data: make([]byte, 10), contentType: "audio/l16; rate=-8000", wantErr: true},
+		{name: "l16 rate not a number", data: make([]byte, 10), contentType: "audio/l16; rate=fast", wantErr: true},
+
+		{name: "empty", data: nil, wantErr: true},
+		{name: "empty with a content type", data: nil, contentType: "audio/webm", wantErr: true},
+		{name: "unknown bytes", data: []byte("hello world"), contentType: "text/plain", wantErr: true},
+		{name: "bad content type", data: []byte{0x00}, contentType: ";;;", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := sniffAudio(tt.data, tt.contentType)
+			if tt.wantErr {
+				if !errors.Is(err, errUnsupportedAudio) {
+					t.Fatalf("got %+v, %v, want errUnsupportedAudio", in, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in.format != tt.wantFormat || in.encoding != tt.wantEncoding {
+				t.Errorf("format, encoding = %s, %v, want %s, %v", in.format, in.encoding, tt.wantFormat, tt.wantEncoding)
+			}
+			if in.sampleRate != tt.wantRate || in.channels != tt.wantChannels {
+				t.Errorf("rate, channels = %d, %d, want %d, %d", in.sampleRate, in.channels, tt.wantRate, tt.wantChannels)
+			}
+			if in.duration != tt.wantDuration {
+				t.Errorf("duration = %v, want %v", in.duration, tt.wantDuration)
+			}
+		})
+	}
+}
+
+// no header, however cut off, may make the sniffers read past the end
+func TestSniffAudioTruncated(t *testing.T) {
+	files := [][]byte{
+		wavFile(1, 2, 48000, 16, 64, true),
+		flacFile(16000, 1, 48000),
+		append([]byte("OggS"), "....OpusHead\x01\x02"...),
+		{0x1A, 0x45, 0xDF, 0xA3, 'A', '_', 'O', 'P', 'U', 'S', 0x9F, 0x81, 0x01},
+		append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), 0xFF, 0xFB, 0x90, 0x00),
+	}
+	for _, f := range files {
+		for n := range len(f) {
+			sniffAudio(f[:n], "")
+		}
+	}
+}
@@ -3,35 +3,161 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/vertexai/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func (cfg *config) generateResponse(ctx context.Context, session *ChatSession) (string, error) {
-	client, err := genai.NewClient(ctx, cfg.clientConfig.Project, cfg.clientConfig.Location)
+// retryable grpc codes, anything else fails the attempt straight away
+var retryableCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.ResourceExhausted: true,
+	codes.DeadlineExceeded:  true,
+	codes.Aborted:           true,
+	codes.Internal:          true,
+}
+
+// vars so tests dont have to sit through them
+var (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 8 * time.Second
+)
+
+// generateResponse sends turn on top of the session history and returns the model's reply.
+// it doesnt touch session.ChatHistory, the caller appends turn and reply once this succeeds
+// so a failed turn leaves the session as it was.
+func (cfg *config) generateResponse(ctx context.Context, history []*genai.Content, turn *genai.Content) (reply string, usage *genai.UsageMetadata, err error) {
+	ctx, span := startSpan(ctx, "generateResponse", attribute.Int("history.messages", len(history)))
+	defer func() { endSpan(span, err) }()
+
+	return cfg.generate(ctx, getSystemInstructions(), history, turn)
+}
+
+// modelClient is the part of the vertex client generate uses. it is an interface so a fake can stand in for the model.
+type modelClient interface {
+	// SendMessage sends turn on top of history to the named model.
+	SendMessage(ctx context.Context, model string, instructions []genai.Part, history []*genai.Content, turn *genai.Content) (*genai.GenerateContentResponse, error)
+	Close() error
+}
+
+type vertexClient struct {
+	client *genai.Client
+}
+
+func (c ClientConfig) newVertexClient(ctx context.Context) (modelClient, error) {
+	client, err := genai.NewClient(ctx, c.Project, c.Location)
 	if err != nil {
-		log.Printf("Failed to create genai client: %v", err)
-		return "", fmt.Errorf("failed to create AI client")
+		return nil, err
 	}
-	defer client.Close()
+	return vertexClient{client: client}, nil
+}
 
-	model := client.GenerativeModel("gemini-2.0-flash-001")
+func (v vertexClient) SendMessage(ctx context.Context, name string, instructions []genai.Part, history []*genai.Content, turn *genai.Content) (*genai.GenerateContentResponse, error) {
+	model := v.client.GenerativeModel(name)
 	model.SystemInstruction = &genai.Content{
-		Parts: getSystemInstructions(),
+		Parts: instructions,
 	}
-
 	cs := model.StartChat()
-	cs.History = session.ChatHistory
+	// clipped so SendMessage appending the turn can never write into the session's backing array
+	cs.History = slices.Clip(history)
+	return cs.SendMessage(ctx, turn.Parts...)
+}
+
+func (v vertexClient) Close() error {
+	return v.client.Close()
+}
 
-	lastMessage := session.ChatHistory[len(session.ChatHistory)-1]
-	resp, err := cs.SendMessage(ctx, lastMessage.Parts...)
+// generate does one model call with retries, falling back to the secondary model if the primary keeps failing.
+// all of it has to fit in callTimeout, so a user waits for one slow turn at most that long.
+func (cfg *config) generate(ctx context.Context, instructions []genai.Part, history []*genai.Content, turn *genai.Content) (string, *genai.UsageMetadata, error) {
+	if cfg.model.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.model.callTimeout)
+		defer cancel()
+	}
+
+	client, err := cfg.newModelClient(ctx)
 	if err != nil {
-		log.Printf("Error sending message to AI for session %s: %v", session.ID, err)
-		return "", fmt.Errorf("error getting response from AI")
+		slog.ErrorContext(ctx, "failed to create genai client", "error", err)
+		return "", nil, fmt.Errorf("failed to create AI client")
+	}
+	defer client.Close()
+
+	models := []string{cfg.model.name}
+	if cfg.model.fallback != "" && cfg.model.fallback != cfg.model.name {
+		models = append(models, cfg.model.fallback)
+	}
+
+	for i, name := range models {
+		if i > 0 {
+			slog.WarnContext(ctx, "falling back to secondary model", "model", name)
+		}
+
+		resp, err := cfg.sendWithRetry(ctx, client, name, instructions, history, turn)
+		if err == nil {
+			if u := resp.UsageMetadata; u != nil {
+				trace.SpanFromContext(ctx).SetAttributes(
+					attribute.String("model", name),
+					attribute.Int("tokens.prompt", int(u.PromptTokenCount)),
+					attribute.Int("tokens.output", int(u.CandidatesTokenCount)),
+				)
+				modelTokens.WithLabelValues(name, "prompt").Add(float64(u.PromptTokenCount))
+				modelTokens.WithLabelValues(name, "output").Add(float64(u.CandidatesTokenCount))
+			}
+			text, err := responseText(resp)
+			if err != nil {
+				errorsTotal.WithLabelValues(causeModelResponse).Inc()
+			}
+			return text, resp.UsageMetadata, err
+		}
+		errorsTotal.WithLabelValues(causeModelCall).Inc()
+		slog.ErrorContext(ctx, "model call failed", "model", name, "error", err)
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
+	return "", nil, fmt.Errorf("error getting response from AI")
+}
+
+func (cfg *config) sendWithRetry(ctx context.Context, client modelClient, name string, instructions []genai.Part, history []*genai.Content, turn *genai.Content) (*genai.GenerateContentResponse, error) {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		callCtx, cancel := context.WithTimeout(ctx, cfg.model.timeout)
+		resp, err := client.SendMessage(callCtx, name, instructions, history, turn)
+		cancel()
+		modelCallDuration.WithLabelValues(name, outcome(err)).Observe(time.Since(start).Seconds())
+		if err == nil {
+			return resp, nil
+		}
+
+		if attempt >= cfg.model.maxRetries || !retryableCodes[status.Code(err)] || ctx.Err() != nil {
+			return nil, err
+		}
+
+		// full jitter, so retries from concurrent sessions dont line up
+		wait := time.Duration(rand.Int64N(int64(backoff)))
+		slog.WarnContext(ctx, "retrying model call", "model", name, "wait", wait.String(), "attempt", attempt+1, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func responseText(resp *genai.GenerateContentResponse) (string, error) {
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
 		return "", fmt.Errorf("received an empty response from the AI")
 	}
 
@@ -43,16 +169,44 @@ func (cfg *config) generateResponse(ctx context.Context, session *ChatSession) (
 	return string(fullResponse), nil
 }
 
-func buildInitialPrompt(articleLink string, timeLimit int) []*genai.Content {
-	initialUserPrompt := fmt.Sprintf(
-		"Article to analyze: %s\nTime limit for this interview is: %d seconds. Please analyse the article and ask questions about it. If the article answers/solves a problem, the ask the problem statement. If not, just ask general questions",
-		articleLink, timeLimit,
-	)
-	return []*genai.Content{
-		{
-			Parts: []genai.Part{genai.Text(initialUserPrompt)},
-			Role:  "user",
-		},
+// buildInitialPrompt sets the interview up from one article, several, or just a topic.
+func buildInitialPrompt(sources []articleSource, topic string, timeLimit int) *genai.Content {
+	var b strings.Builder
+	switch len(sources) {
+	case 0:
+		fmt.Fprintf(&b, "Topic for this interview: %s\nTime limit for this interview is: %d seconds. There is no article, come up with one system design problem that is a good way to practise %s and ask it.", topic, timeLimit, topic)
+	case 1:
+		fmt.Fprintf(&b, "Article to analyze: %s\nTime limit for this interview is: %d seconds. Please analyse the article and ask questions about it. If the article answers/solves a problem, the ask the problem statement. If not, just ask general questions", sources[0].URL, timeLimit)
+		if topic != "" {
+			fmt.Fprintf(&b, "\nKeep the problem about %s.", topic)
+		}
+		if sources[0].ProblemStatement != "" {
+			fmt.Fprintf(&b, "\nThe problem the article seems to solve: %s", sources[0].ProblemStatement)
+		}
+		if sources[0].Content != "" {
+			fmt.Fprintf(&b, "\n\nArticle text:\n%s", sources[0].Content)
+		}
+	default:
+		fmt.Fprintf(&b, "Time limit for this interview is: %d seconds. Below are %d articles. Synthesize ONE system design problem that draws on all of them and ask it as a single question, do not interview about each article separately.", timeLimit, len(sources))
+		if topic != "" {
+			fmt.Fprintf(&b, " The problem should be about %s.", topic)
+		}
+		for i, s := range sources {
+			fmt.Fprintf(&b, "\n\nArticle %d: %s", i+1, s.URL)
+			if s.Title != "" {
+				fmt.Fprintf(&b, " (%s)", s.Title)
+			}
+			if s.ProblemStatement != "" {
+				fmt.Fprintf(&b, "\nProblem: %s", s.ProblemStatement)
+			}
+			if s.Content != "" {
+				fmt.Fprintf(&b, "\n%s", s.Content)
+			}
+		}
+	}
+	return &genai.Content{
+		Parts: []genai.Part{genai.Text(b.String())},
+		Role:  "user",
 	}
 }
 
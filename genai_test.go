@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeReply struct {
+	text   string
+	tokens int32
+	err    error
+	// hang until the call's context is done
+	hang bool
+}
+
+type fakeCall struct {
+	model   string
+	history []*genai.Content
+	turn    *genai.Content
+}
+
+// fakeModel answers with replies in order, repeating the last one, and records what it was sent.
+type fakeModel struct {
+	replies []fakeReply
+
+	mu    sync.Mutex
+	calls []fakeCall
+}
+
+func (f *fakeModel) SendMessage(ctx context.Context, model string, instructions []genai.Part, history []*genai.Content, turn *genai.Content) (*genai.GenerateContentResponse, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{model: model, history: history, turn: turn})
+	r := f.replies[min(len(f.calls), len(f.replies))-1]
+	f.mu.Unlock()
+
+	if r.hang {
+		<-ctx.Done()
+		// what grpc returns for it
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &genai.GenerateContentResponse{
+		Candidates:    []*genai.Candidate{{Content: &genai.Content{Parts: []genai.Part{genai.Text(r.text)}, Role: "model"}}},
+		UsageMetadata: &genai.UsageMetadata{TotalTokenCount: r.tokens},
+	}, nil
+}
+
+func (f *fakeModel) Close() error { return nil }
+
+func (f *fakeModel) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+// fakeModelConfig is a config whose model calls all go to f.
+func fakeModelConfig(f *fakeModel) *config {
+	return &config{
+		newModelClient: func(context.Context) (modelClient, error) { return f, nil },
+		model:          modelConfig{name: "primary", timeout: time.Second},
+	}
+}
+
+func (f *fakeModel) models() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var models []string
+	for _, c := range f.calls {
+		models = append(models, c.model)
+	}
+	return models
+}
+
+func TestGenerateRetriesAndFallsBack(t *testing.T) {
+	saved := initialBackoff
+	initialBackoff = time.Millisecond
+	t.Cleanup(func() { initialBackoff = saved })
+
+	unavailable := fakeReply{err: status.Error(codes.Unavailable, "overloaded")}
+	invalid := fakeReply{err: status.Error(codes.InvalidArgument, "bad request")}
+	ok := fakeReply{text: "hello", tokens: 7}
+
+	tests := []struct {
+		name       string
+		replies    []fakeReply
+		fallback   string
+		maxRetries int
+		wantModels []string
+		wantErr    bool
+	}{
+		{name: "first try", replies: []fakeReply{ok}, fallback: "backup", maxRetries: 2, wantModels: []string{"primary"}},
+		{name: "retryable error is retried", replies: []fakeReply{unavailable, unavailable, ok}, fallback: "backup", maxRetries: 2, wantModels: []string{"primary", "primary", "primary"}},
+		{name: "other errors go straight to the fallback", replies: []fakeReply{invalid, ok}, fallback: "backup", maxRetries: 2, wantModels: []string{"primary", "backup"}},
+		{name: "plain errors are not retried either", replies: []fakeReply{{err: errors.New("boom")}, ok}, fallback: "backup", maxRetries: 2, wantModels: []string{"primary", "backup"}},
+		{name: "retries used up", replies: []fakeReply{unavailable, unavailable, ok}, fallback: "backup", maxRetries: 1, wantModels: []string{"primary", "primary", "backup"}},
+		{name: "fallback retries too", replies: []fakeReply{unavailable}, fallback: "backup", maxRetries: 1, wantModels: []string{"primary", "primary", "backup", "backup"}, wantErr: true},
+		{name: "no fallback", replies: []fakeReply{invalid}, wantModels: []string{"primary"}, wantErr: true},
+		{name: "fallback same as primary", replies: []fakeReply{invalid}, fallback: "primary", wantModels: []string{"primary"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := &fakeModel{replies: tt.replies}
+			cfg := fakeModelConfig(model)
+			cfg.model.fallback = tt.fallback
+			cfg.model.maxRetries = tt.maxRetries
+
+			text, usage, err := cfg.generate(context.Background(), nil, nil, &genai.Content{Parts: []genai.Part{genai.Text("hi")}})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", text)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if text != "hello" || usage.TotalTokenCount != 7 {
+				t.Errorf("got %q with %v tokens", text, usage.TotalTokenCount)
+			}
+			if got := model.models(); !slices.Equal(got, tt.wantModels) {
+				t.Errorf("called %v, want %v", got, tt.wantModels)
+			}
+		})
+	}
+}
+
+// retries and the fallback all come out of the same deadline
+func TestGenerateCallTimeout(t *testing.T) {
+	model := &fakeModel{replies: []fakeReply{{hang: true}}}
+	cfg := fakeModelConfig(model)
+	cfg.model.fallback = "backup"
+	cfg.model.maxRetries = 3
+	cfg.model.timeout = time.Minute
+	cfg.model.callTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, _, err := cfg.generate(context.Background(), nil, nil, &genai.Content{Parts: []genai.Part{genai.Text("hi")}})
+	if err == nil {
+		t.Fatal("want an error once the call timed out")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("took %v, want about the 50ms call timeout", took)
+	}
+	if got := model.models(); !slices.Equal(got, []string{"primary"}) {
+		t.Errorf("called %v, nothing should be tried after the deadline", got)
+	}
+}
+
+// a hung attempt is cut off by the per attempt timeout and retried
+func TestGenerateAttemptTimeout(t *testing.T) {
+	saved := initialBackoff
+	initialBackoff = time.Millisecond
+	t.Cleanup(func() { initialBackoff = saved })
+
+	model := &fakeModel{replies: []fakeReply{{hang: true}, {text: "hello"}}}
+	cfg := fakeModelConfig(model)
+	cfg.model.maxRetries = 1
+	cfg.model.timeout = 20 * time.Millisecond
+	cfg.model.callTimeout = time.Minute
+
+	text, _, err := cfg.generate(context.Background(), nil, nil, &genai.Content{Parts: []genai.Part{genai.Text("hi")}})
+	if err != nil || text != "hello" {
+		t.Fatalf("got %q, %v, want the retry's reply", text, err)
+	}
+	if model.callCount() != 2 {
+		t.Errorf("made %d calls, want 2", model.callCount())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// the first user prompt (article + time limit) and the model's opening question
+// are the problem statement, they are never folded into the summary
+const problemStatementTurns = 2
+
+const summaryPrefix = "Interview so far (summary of the earlier discussion): "
+
+// compactHistory folds the older turns of history into a single "interview so far" note once
+// contextTokens, the last measured context size, went over the budget. the problem statement and
+// the most recent turns are kept as is. it returns nil when there was nothing to do and never
+// changes history, so it runs on a copy taken under session.mu without holding it.
+func (cfg *config) compactHistory(ctx context.Context, session *ChatSession, history []*genai.Content, contextTokens int) ([]*genai.Content, error) {
+	if cfg.model.contextTokenBudget <= 0 || contextTokens <= cfg.model.contextTokenBudget {
+		return nil, nil
+	}
+
+	// keep whole user/model pairs so the roles keep alternating after the note
+	keep := cfg.model.keepRecentTurns * 2
+	end := len(history) - keep
+	if end-problemStatementTurns < 2 {
+		return nil, nil
+	}
+	older := history[problemStatementTurns:end]
+
+	ctx, span := startSpan(ctx, "compactHistory", attribute.Int("history.folded", len(older)))
+	defer span.End()
+
+	summary, usage, err := cfg.generate(ctx, getSummaryInstructions(), nil, &genai.Content{
+		Parts: []genai.Part{genai.Text(transcript(older))},
+		Role:  "user",
+	})
+	if err != nil {
+		span.RecordError(err)
+		errorsTotal.WithLabelValues(causeSummary).Inc()
+		return nil, fmt.Errorf("failed to summarize history: %w", err)
+	}
+	recordUsage(session.UserID, session, tokenUsage(usage))
+
+	compacted := make([]*genai.Content, 0, problemStatementTurns+2+keep)
+	compacted = append(compacted, history[:problemStatementTurns]...)
+	compacted = append(compacted,
+		&genai.Content{Parts: []genai.Part{genai.Text(summaryPrefix + summary)}, Role: "user"},
+		&genai.Content{Parts: []genai.Part{genai.Text("Got it, let's continue from there.")}, Role: "model"},
+	)
+	compacted = append(compacted, history[end:]...)
+
+	slog.InfoContext(ctx, "compacted chat history",
+		"messagesBefore", len(history), "messagesAfter", len(compacted),
+		"contextTokens", contextTokens, "budget", cfg.model.contextTokenBudget)
+	return compacted, nil
+}
+
+func transcript(history []*genai.Content) string {
+	var b strings.Builder
+	for _, c := range history {
+		speaker := "<user>"
+		if c.Role == "model" {
+			speaker = "<interviewer>"
+		}
+		b.WriteString(speaker)
+		b.WriteString(": ")
+		for _, p := range c.Parts {
+			if t, ok := p.(genai.Text); ok {
+				b.WriteString(string(t))
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func getSummaryInstructions() []genai.Part {
+	return []genai.Part{
+		genai.Text("You summarize part of a system design practice interview so the interviewer can continue it without the full transcript."),
+		genai.Text("The transcript may start with an earlier summary, merge it into the new one instead of repeating it."),
+		genai.Text("Keep the components the user proposed, the trade-offs discussed, the hints already given, and the open questions or weak spots the interviewer wanted to come back to."),
+		genai.Text("Drop small talk and the exact wording. Write plain text, no markdown, at most 200 words."),
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// testHistory is the problem statement followed by n user/model exchanges.
+func testHistory(n int) []*genai.Content {
+	history := []*genai.Content{
+		{Parts: []genai.Part{genai.Text("article")}, Role: "user"},
+		{Parts: []genai.Part{genai.Text("design it")}, Role: "model"},
+	}
+	for i := range n {
+		history = append(history,
+			&genai.Content{Parts: []genai.Part{genai.Text("answer " + strconv.Itoa(i))}, Role: "user"},
+			&genai.Content{Parts: []genai.Part{genai.Text("reply " + strconv.Itoa(i))}, Role: "model"},
+		)
+	}
+	return history
+}
+
+func TestCompactHistoryNothingToDo(t *testing.T) {
+	tests := []struct {
+		name          string
+		budget        int
+		keep          int
+		exchanges     int
+		contextTokens int
+	}{
+		{name: "budget off", budget: 0, keep: 2, exchanges: 10, contextTokens: 1_000_000},
+		{name: "under the budget", budget: 1000, keep: 2, exchanges: 10, contextTokens: 999},
+		{name: "at the budget", budget: 1000, keep: 2, exchanges: 10, contextTokens: 1000},
+		{name: "only the recent turns", budget: 1000, keep: 4, exchanges: 4, contextTokens: 2000},
+		{name: "fewer than the recent turns", budget: 1000, keep: 4, exchanges: 2, contextTokens: 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{model: modelConfig{contextTokenBudget: tt.budget, keepRecentTurns: tt.keep}}
+			got, err := cfg.compactHistory(context.Background(), &ChatSession{}, testHistory(tt.exchanges), tt.contextTokens)
+			if err != nil || got != nil {
+				t.Fatalf("got %d messages, %v, want nil", len(got), err)
+			}
+		})
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	model := &fakeModel{replies: []fakeReply{{text: "they sharded by user", tokens: 40}}}
+	cfg := fakeModelConfig(model)
+	cfg.model.contextTokenBudget = 1000
+	cfg.model.keepRecentTurns = 2
+	session := &ChatSession{}
+	history := testHistory(6)
+	before := slices.Clone(history)
+
+	got, err := cfg.compactHistory(context.Background(), session, history, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// problem statement, the note and its ack, then the last two exchanges word for word
+	want := []string{"article", "design it", summaryPrefix + "they sharded by user", "Got it, let's continue from there.", "answer 4", "reply 4", "answer 5", "reply 5"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i, c := range got {
+		if text := string(c.Parts[0].(genai.Text)); text != want[i] {
+			t.Errorf("message %d = %q, want %q", i, text, want[i])
+		}
+		if wantRole := []string{"user", "model"}[i%2]; c.Role != wantRole {
+			t.Errorf("message %d role = %q, want %q", i, c.Role, wantRole)
+		}
+	}
+	if got[0] != history[0] || got[7] != history[13] {
+		t.Error("kept messages should be the same contents, not copies")
+	}
+	if !slices.Equal(history, before) {
+		t.Error("history was changed")
+	}
+
+	// only the folded exchanges go to the summary
+	if model.callCount() != 1 {
+		t.Fatalf("made %d model calls, want 1", model.callCount())
+	}
+	sent := string(model.calls[0].turn.Parts[0].(genai.Text))
+	for i := range 6 {
+		folded := strings.Contains(sent, "answer "+strconv.Itoa(i)+" ")
+		if folded != (i < 4) {
+			t.Errorf("answer %d in the summary request = %v, want %v", i, folded, i < 4)
+		}
+	}
+	if strings.Contains(sent, "design it") {
+		t.Error("the problem statement was sent to be summarized")
+	}
+	if len(model.calls[0].history) != 0 {
+		t.Error("the summary request should not carry the chat history")
+	}
+	if sessionUsage(session).TotalTokens != 40 {
+		t.Errorf("session tokens = %d, want the summary's 40", sessionUsage(session).TotalTokens)
+	}
+}
+
+// a summary made from an earlier summary keeps the new note in the same place
+func TestCompactHistoryTwice(t *testing.T) {
+	cfg := fakeModelConfig(&fakeModel{replies: []fakeReply{{text: "first"}, {text: "second"}}})
+	cfg.model.contextTokenBudget = 1000
+	cfg.model.keepRecentTurns = 1
+
+	once, err := cfg.compactHistory(context.Background(), &ChatSession{}, testHistory(4), 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grown := append(slices.Clip(once), testHistory(3)[2:]...)
+	twice, err := cfg.compactHistory(context.Background(), &ChatSession{}, grown, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(twice) != 6 || string(twice[2].Parts[0].(genai.Text)) != summaryPrefix+"second" {
+		t.Errorf("got %d messages, note %v", len(twice), twice[2].Parts)
+	}
+}
+
+func TestCompactHistoryModelError(t *testing.T) {
+	model := &fakeModel{replies: []fakeReply{{err: errors.New("model down")}}}
+	cfg := fakeModelConfig(model)
+	cfg.model.contextTokenBudget = 1000
+	cfg.model.keepRecentTurns = 2
+	history := testHistory(6)
+	before := slices.Clone(history)
+
+	got, err := cfg.compactHistory(context.Background(), &ChatSession{}, history, 2000)
+	if err == nil || got != nil {
+		t.Fatalf("got %d messages, %v, want nil and an error", len(got), err)
+	}
+	if model.callCount() != 1 {
+		t.Errorf("made %d model calls, want 1", model.callCount())
+	}
+	if !slices.Equal(history, before) {
+		t.Error("history was changed")
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	got := transcript([]*genai.Content{
+		{Parts: []genai.Part{genai.Text("shard by user"), genai.Text("time remaining : 60 seconds")}, Role: "user"},
+		{Parts: []genai.Part{genai.Text("why?")}, Role: "model"},
+	})
+	want := "<user>: shard by user time remaining : 60 seconds \n<interviewer>: why? \n"
+	if got != want {
+		t.Errorf("transcript = %q, want %q", got, want)
+	}
+}
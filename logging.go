@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newLogger writes json lines that cloud logging understands: severity instead of level, message instead of msg,
+// and the trace fields so log lines show up under their trace.
+func newLogger(w io.Writer, level slog.Level, projectID string) *slog.Logger {
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				return slog.String("severity", severity(a.Value.Any().(slog.Level)))
+			case slog.MessageKey:
+				a.Key = "message"
+			}
+			return a
+		},
+	})
+	return slog.New(contextHandler{Handler: h, projectID: projectID})
+}
+
+func severity(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return "ERROR"
+	case l >= slog.LevelWarn:
+		return "WARNING"
+	case l >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+func logLevel() slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(envString("LOG_LEVEL", "info"))); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// fatal is log.Fatal for startup errors, with the right severity.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestInfo is filled in while a request is handled, every line logged with its context gets these ids.
+type requestInfo struct {
+	id string
+
+	mu        sync.Mutex
+	sessionID string
+	userID    string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setRequestSessionID attaches the session to the rest of the request's logs, including the access log line,
+// and to the request's span.
+func setRequestSessionID(ctx context.Context, sessionID string) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.mu.Lock()
+		info.sessionID = sessionID
+		info.mu.Unlock()
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("session.id", sessionID))
+}
+
+type contextHandler struct {
+	slog.Handler
+	projectID string
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.mu.Lock()
+		r.AddAttrs(slog.String("requestId", info.id), slog.String("userId", info.userID))
+		if info.sessionID != "" {
+			r.AddAttrs(slog.String("sessionId", info.sessionID))
+		}
+		info.mu.Unlock()
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() && h.projectID != "" {
+		r.AddAttrs(
+			slog.String("logging.googleapis.com/trace", "projects/"+h.projectID+"/traces/"+sc.TraceID().String()),
+			slog.String("logging.googleapis.com/spanId", sc.SpanID().String()),
+			slog.Bool("logging.googleapis.com/trace_sampled", sc.IsSampled()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithAttrs(attrs), projectID: h.projectID}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithGroup(name), projectID: h.projectID}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush on the real writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// requestLogger gives every request an id (kept if the caller sent X-Request-ID) and logs one line per request.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = uuid.New().String()
+		}
+		info := &requestInfo{id: id, userID: userID(r)}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		w.Header().Set("X-Request-ID", id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		latency := time.Since(start)
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		// httpRequest is the group cloud logging shows as the request summary, latency is a "0.25s" style string there
+		slog.Log(r.Context(), level, "request handled",
+			slog.Group("httpRequest",
+				slog.String("requestMethod", r.Method),
+				slog.String("requestUrl", r.URL.String()),
+				slog.Int("status", rec.status),
+				slog.Int("responseSize", rec.bytes),
+				slog.String("remoteIp", clientIP(r)),
+				slog.String("userAgent", r.UserAgent()),
+				slog.String("latency", strconv.FormatFloat(latency.Seconds(), 'f', -1, 64)+"s"),
+			),
+			slog.String("route", r.Pattern),
+			slog.Float64("latencyMs", float64(latency.Microseconds())/1000),
+		)
+	})
+}
@@ -1,26 +1,73 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"cloud.google.com/go/vertexai/genai"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	"github.com/rs/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // configss
 type config struct {
 	port         string
 	clientConfig ClientConfig
+	// vertex unless a test swaps it
+	newModelClient func(context.Context) (modelClient, error)
+	model          modelConfig
+	quota          quotaConfig
+	adminToken     string
+	// empty when ffmpeg isnt installed, uploads that need transcoding get a 415 then
+	ffmpegPath string
+
+	sttMaxUpload int64
+	// picked by STT_BACKEND and TTS_BACKEND, see speechBackends
+	sttBackend string
+	ttsBackend string
+	stt        SpeechToText
+	tts        TextToSpeech
+	// nil when TTS_CACHE_MB is 0 and there is no TTS_CACHE_DIR
+	ttsCache             *ttsCache
+	ttsStreamParallelism int
+	// nil when ARTICLE_CACHE_ENTRIES is 0
+	articleCache *articleCache
+	maxPause     time.Duration
+	// active sessions left alone this long are ended, 0 keeps them
+	idleTimeout time.Duration
+	// how long ended sessions are kept before they are dropped from memory
+	sessionRetention time.Duration
+}
+
+type modelConfig struct {
+	name     string
+	fallback string
+	// per attempt
+	timeout time.Duration
+	// for all of one call, every retry and the fallback included
+	callTimeout time.Duration
+	maxRetries  int
+
+	// once a turn's prompt + reply goes over this many tokens the older turns get summarized, 0 turns it off
+	contextTokenBudget int
+	// exchanges kept word for word after summarizing
+	keepRecentTurns int
 }
 
 type ClientConfig struct {
@@ -29,13 +76,49 @@ type ClientConfig struct {
 }
 
 type ChatSession struct {
-	ID               string
-	ChatHistory      []*genai.Content
-	ArticleURL       string
+	ID          string
+	UserID      string
+	ChatHistory []*genai.Content
+	// what the user saw, for reloading the page. guarded by mu
+	Messages         []Message
+	ArticleURL       string // the first of ArticleURLs, empty for topic only sessions
+	ArticleURLs      []string
+	Topic            string
+	Persona          string
 	StartTime        time.Time
 	TimeLimitSeconds int
 	IsActive         bool
 	LastActivityTime time.Time
+	// zero unless paused. the clock starts again at PauseEndsAt if nobody resumes before that
+	PausedAt    time.Time
+	PauseEndsAt time.Time
+	// closed pauses, left out of the time limit
+	PausedTotal time.Duration
+	// set once the session ended, see end
+	EndReason string
+	EndedAt   time.Time
+	// the session this one was forked from by a rewind
+	ForkedFrom string
+
+	// terms from the article and the opening question, boosted in /stt requests for this session
+	Vocabulary []string
+	Voice      VoiceSettings
+
+	// tokens of the last prompt + reply, system instructions included
+	ContextTokens int
+	// guarded by usageMutex, not mu
+	Usage Usage
+	// one entry per recorded answer, guarded by speakingMutex
+	Speaking []SpeakingTurn
+
+	// responses already sent for a client supplied turn id, so retried
+	// requests get the same answer instead of a second model call
+	TurnResponses map[string]turnResponse
+
+	// a model call for this session is running. mu is only held around it, so this
+	// is what keeps a second turn, the wrap-up or a rewind from starting meanwhile
+	turnInFlight bool
+	mu           sync.Mutex
 }
 
 var (
@@ -46,52 +129,171 @@ var (
 func main() {
 	_ = godotenv.Load()
 
+	slog.SetDefault(newLogger(os.Stdout, logLevel(), os.Getenv("PROJECT_ID")))
+	trustUserIDHeader = envBool("TRUST_USER_ID_HEADER", false)
+	trustProxy = envBool("TRUST_PROXY", false)
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 	projectID := os.Getenv("PROJECT_ID")
 	if projectID == "" {
-		log.Fatal("PROJECT_ID environment variable not set")
+		fatal("PROJECT_ID environment variable not set")
 	}
 	location := os.Getenv("LOCATION")
 	if location == "" {
-		log.Fatal("LOCATION environment variable not set")
+		fatal("LOCATION environment variable not set")
 	}
 
+	security := loadSecurityConfig()
+
 	clientConfig := ClientConfig{
 		Project:  projectID,
 		Location: location,
 	}
 	cfg := config{
-		port:         port,
-		clientConfig: clientConfig,
+		port:           port,
+		clientConfig:   clientConfig,
+		newModelClient: clientConfig.newVertexClient,
+		model: modelConfig{
+			name:        envString("MODEL_NAME", "gemini-2.0-flash-001"),
+			fallback:    envString("FALLBACK_MODEL_NAME", "gemini-2.0-flash-lite-001"),
+			timeout:     time.Duration(envInt("MODEL_TIMEOUT_SECONDS", 30)) * time.Second,
+			callTimeout: time.Duration(envInt("MODEL_CALL_TIMEOUT_SECONDS", 60)) * time.Second,
+			maxRetries:  envInt("MODEL_MAX_RETRIES", 3),
+
+			contextTokenBudget: envInt("CONTEXT_TOKEN_BUDGET", 32000),
+			keepRecentTurns:    envInt("SUMMARY_KEEP_TURNS", 4),
+		},
+		quota: quotaConfig{
+			dailyTokens:       int64(envInt("DAILY_TOKEN_QUOTA", 0)),
+			dailyAudioSeconds: float64(envInt("DAILY_STT_SECONDS_QUOTA", 0)),
+			dailyTtsChars:     int64(envInt("DAILY_TTS_CHARS_QUOTA", 0)),
+		},
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+		ffmpegPath: ffmpegPath(),
+
+		// streaming recognition stops at about 5 minutes, 25MB is plenty for that in any format we take
+		sttMaxUpload: int64(envInt("STT_MAX_UPLOAD_MB", 25)) << 20,
+		ttsCache:     newTTSCache(ttsCacheMaxBytes(), os.Getenv("TTS_CACHE_DIR")),
+		// sentences synthesized at once per /tts/stream request
+		ttsStreamParallelism: envInt("TTS_STREAM_PARALLELISM", 3),
+
+		articleCache: newArticleCache(envInt("ARTICLE_CACHE_ENTRIES", 500), time.Duration(envInt("ARTICLE_CACHE_TTL_MINUTES", 360))*time.Minute),
+		// pause time each session gets in total
+		maxPause:    time.Duration(envInt("SESSION_MAX_PAUSE_MINUTES", 15)) * time.Minute,
+		idleTimeout: time.Duration(envInt("SESSION_IDLE_MINUTES", 30)) * time.Minute,
+		// ended sessions are kept this long for the summary and forks
+		sessionRetention: time.Duration(envInt("SESSION_RETENTION_MINUTES", 60)) * time.Minute,
 	}
+	// transcripts below STT_LOW_CONFIDENCE are flagged for the user to confirm
+	if err := cfg.speechBackends(float32(envFloat("STT_LOW_CONFIDENCE", 0.7))); err != nil {
+		fatal("failed to set up speech backends", "error", err)
+	}
+
+	go cfg.reapSessions(context.Background())
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("GET /health", health)
-	mux.HandleFunc("POST /start", cfg.startChatHandler)
-	mux.HandleFunc("POST /chat/{sessionId}", cfg.chatHandler)
-	mux.HandleFunc("POST /stt", cfg.sttHandler)
-	mux.HandleFunc("POST /tts", cfg.ttsHandler)
-
-	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Accept"},
-		AllowCredentials: false,
-	})
+	limiter := &rateLimiter{store: newMemoryLimiterStore(), clock: realClock{}}
 
-	handler := c.Handler(mux)
+	mux.HandleFunc("GET /health", health)
+	mux.HandleFunc("POST /start", limiter.limit("start", envRateLimit("START", 5, 3), cfg.startChatHandler))
+	mux.HandleFunc("POST /chat/{sessionId}", limiter.limit("chat", envRateLimit("CHAT", 20, 5), cfg.chatHandler))
+	mux.HandleFunc("POST /stt", limiter.limit("stt", envRateLimit("STT", 20, 5), cfg.sttHandler))
+	mux.HandleFunc("POST /tts", limiter.limit("tts", envRateLimit("TTS", 30, 10), cfg.ttsHandler))
+	mux.HandleFunc("POST /tts/stream", limiter.limit("tts", envRateLimit("TTS", 30, 10), cfg.ttsStreamHandler))
+	// media elements fire a range request per seek, so this one gets more room than /tts
+	mux.HandleFunc("GET /tts/{key}", limiter.limit("tts_audio", envRateLimit("TTS_AUDIO", 120, 30), cfg.ttsAudioHandler))
+	mux.HandleFunc("GET /voices", limiter.limit("voices", envRateLimit("VOICES", 30, 10), cfg.voicesHandler))
+	mux.HandleFunc("GET /session/{sessionId}", limiter.limit("session", envRateLimit("SESSION", 60, 20), cfg.sessionHandler))
+	mux.HandleFunc("GET /session/{sessionId}/messages", limiter.limit("session", envRateLimit("SESSION", 60, 20), cfg.messagesHandler))
+	mux.HandleFunc("POST /session/{sessionId}/rewind", limiter.limit("session", envRateLimit("SESSION", 60, 20), cfg.rewindHandler))
+	mux.HandleFunc("POST /session/{sessionId}/end", limiter.limit("session", envRateLimit("SESSION", 60, 20), cfg.endSessionHandler))
+	mux.HandleFunc("POST /session/{sessionId}/pause", limiter.limit("session", envRateLimit("SESSION", 60, 20), cfg.pauseHandler))
+	mux.HandleFunc("POST /session/{sessionId}/resume", limiter.limit("session", envRateLimit("SESSION", 60, 20), cfg.resumeHandler))
+	mux.HandleFunc("GET /session/{sessionId}/speaking-report", limiter.limit("session", envRateLimit("SESSION", 60, 20), cfg.speakingReportHandler))
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /admin/usage", limiter.limit("admin", envRateLimit("ADMIN", 30, 10), cfg.usageHandler))
+
+	handler := otelhttp.NewHandler(
+		requestLogger(routeSpanName(httpMetrics(security.securityHeaders(security.cors().Handler(mux))))),
+		"http",
+	)
 
 	s := http.Server{
 		Addr:    ":" + cfg.port,
 		Handler: handler,
 	}
 
-	log.Printf("server listening on port: %v ...", s.Addr)
-	log.Fatal(s.ListenAndServe())
+	slog.Info("server listening", "addr", s.Addr)
+	err = s.ListenAndServe()
+	shutdownTracing(context.Background())
+	fatal("server stopped", "error", err)
+}
+
+func envString(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fatal("environment variable must be an integer", "env", key, "value", v)
+	}
+	return n
+}
+
+func envFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		fatal("environment variable must be a number", "env", key, "value", v)
+	}
+	return f
+}
+
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fatal("environment variable must be true or false", "env", key, "value", v)
+	}
+	return b
+}
+
+// envList reads a comma separated list, fallback when unset.
+func envList(key string, fallback []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
 
 func health(w http.ResponseWriter, r *http.Request) {
@@ -101,8 +303,13 @@ func health(w http.ResponseWriter, r *http.Request) {
 
 // types
 type StartChatRequest struct {
-	ArticleLink      string `json:"articleLink"`
-	TimeLimitSeconds int    `json:"timeLimitSeconds"`
+	ArticleLink string `json:"articleLink"`
+	// several articles to build one problem from, instead of or on top of articleLink
+	ArticleLinks []string `json:"articleLinks,omitempty"`
+	// e.g. "rate limiting", on its own or as the focus for the articles
+	Topic            string         `json:"topic,omitempty"`
+	TimeLimitSeconds int            `json:"timeLimitSeconds"`
+	Voice            *VoiceSettings `json:"voice,omitempty"`
 }
 
 type StartChatResponse struct {
@@ -113,6 +320,8 @@ type StartChatResponse struct {
 
 type ChatRequest struct {
 	UserMessage string `json:"userMessage"`
+	// optional, same as the Idempotency-Key header. the header wins if both are set
+	TurnID string `json:"turnId,omitempty"`
 }
 
 type ChatResponse struct {
@@ -120,12 +329,45 @@ type ChatResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
+// turn ids kept per session for replays. turns come one at a time, a client retries
+// the last one or two, not one from twenty answers ago
+const maxTurnResponses = 20
+
+type turnResponse struct {
+	// a reused turn id with a different message is a client bug, not a retry
+	bodyHash string
+	response ChatResponse
+	at       time.Time
+}
+
+func turnHash(userMessage string) string {
+	sum := sha256.Sum256([]byte(userMessage))
+	return hex.EncodeToString(sum[:])
+}
+
+// rememberTurn keeps resp for replays, dropping the oldest once there are maxTurnResponses. callers hold mu.
+func (cs *ChatSession) rememberTurn(turnID, bodyHash string, resp ChatResponse, now time.Time) {
+	cs.TurnResponses[turnID] = turnResponse{bodyHash: bodyHash, response: resp, at: now}
+	for len(cs.TurnResponses) > maxTurnResponses {
+		oldestID, oldest := "", time.Time{}
+		for id, t := range cs.TurnResponses {
+			if oldestID == "" || t.at.Before(oldest) {
+				oldestID, oldest = id, t.at
+			}
+		}
+		delete(cs.TurnResponses, oldestID)
+	}
+}
+
 type TtsRequest struct {
-	Text string `json:"text"`
+	Text      string `json:"text"`
+	SessionID string `json:"sessionId,omitempty"`
+	// overrides the session's voice for this request
+	Voice *VoiceSettings `json:"voice,omitempty"`
 }
 
 type SttResponse struct {
-	Text  string `json:"text,omitempty"`
+	*Transcript
 	Error string `json:"error,omitempty"`
 }
 
@@ -137,42 +379,98 @@ func (cfg *config) startChatHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 		return
 	}
-	if req.ArticleLink == "" || !isURL(req.ArticleLink) {
-		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "A valid 'articleLink' is required"})
+	var articles []string
+	for _, link := range append([]string{req.ArticleLink}, req.ArticleLinks...) {
+		if link = strings.TrimSpace(link); link != "" && !slices.Contains(articles, link) {
+			articles = append(articles, link)
+		}
+	}
+	req.Topic = strings.TrimSpace(req.Topic)
+	if len(articles) == 0 && req.Topic == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "An 'articleLink', 'articleLinks' or a 'topic' is required"})
+		return
+	}
+	if len(articles) > maxArticles {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "At most " + strconv.Itoa(maxArticles) + " articles per session"})
+		return
+	}
+	for _, link := range articles {
+		if !isURL(link) {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Not a valid article link: " + link})
+			return
+		}
+	}
+	if utf8.RuneCountInString(req.Topic) > 200 {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "'topic' must be at most 200 characters"})
 		return
 	}
 
 	if req.TimeLimitSeconds <= 0 {
 		req.TimeLimitSeconds = 300 // Default to 5 minutes
 	}
+	voice := defaultVoice
+	if req.Voice != nil {
+		if err := req.Voice.validate(); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		voice = req.Voice.merge(defaultVoice)
+	}
+
+	uid := userID(r)
+	if cfg.quota.tokensExceeded(uid) {
+		respondQuotaExceeded(w)
+		return
+	}
 
 	sessionID := uuid.New().String()
 	newSession := &ChatSession{
 		ID:               sessionID,
-		ArticleURL:       req.ArticleLink,
+		UserID:           uid,
+		Voice:            voice,
+		ArticleURLs:      articles,
+		Topic:            req.Topic,
+		Persona:          defaultPersona,
 		StartTime:        time.Now(),
 		TimeLimitSeconds: req.TimeLimitSeconds,
 		IsActive:         true,
 		LastActivityTime: time.Now(),
-		ChatHistory:      buildInitialPrompt(req.ArticleLink, req.TimeLimitSeconds),
+		TurnResponses:    make(map[string]turnResponse),
+	}
+
+	if len(articles) > 0 {
+		newSession.ArticleURL = articles[0]
 	}
 
-	llmResponse, err := cfg.generateResponse(r.Context(), newSession)
+	sources := cfg.gatherSources(r.Context(), newSession, articles, req.Topic)
+	initialPrompt := buildInitialPrompt(sources, req.Topic, req.TimeLimitSeconds)
+	llmResponse, usage, err := cfg.generateResponse(r.Context(), newSession.ChatHistory, initialPrompt)
 	if err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, StartChatResponse{Error: err.Error()})
 		return
 	}
+	recordUsage(uid, newSession, tokenUsage(usage))
+	if usage != nil {
+		newSession.ContextTokens = int(usage.TotalTokenCount)
+	}
 
-	newSession.ChatHistory = append(newSession.ChatHistory, &genai.Content{
+	newSession.ChatHistory = append(newSession.ChatHistory, initialPrompt, &genai.Content{
 		Parts: []genai.Part{genai.Text(llmResponse)},
 		Role:  "model",
 	})
+	newSession.addMessage(roleInterviewer, llmResponse, time.Now())
+	var concepts []string
+	for _, s := range sources {
+		concepts = append(concepts, s.Concepts...)
+	}
+	newSession.Vocabulary = sessionVocabulary(articles, concepts, llmResponse)
 
 	sessionsMutex.Lock()
 	chatSessions[sessionID] = newSession
 	sessionsMutex.Unlock()
 
-	log.Println("New session started and initial response generated: ", sessionID)
+	setRequestSessionID(r.Context(), sessionID)
+	slog.InfoContext(r.Context(), "new session started and initial response generated")
 
 	respondWithJSON(w, http.StatusCreated, StartChatResponse{
 		SessionID: sessionID,
@@ -186,12 +484,13 @@ func (cfg *config) chatHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing session ID in URL path"})
 		return
 	}
+	setRequestSessionID(r.Context(), sessionID)
 
 	sessionsMutex.RLock()
 	session, ok := chatSessions[sessionID]
 	sessionsMutex.RUnlock()
 
-	if !ok || !session.IsActive {
+	if !ok {
 		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Session not found or has expired"})
 		return
 	}
@@ -206,31 +505,111 @@ func (cfg *config) chatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session.ChatHistory = append(session.ChatHistory, &genai.Content{
-		Parts: []genai.Part{genai.Text(req.UserMessage), genai.Text("time remaining : ")},
+	turnID := r.Header.Get("Idempotency-Key")
+	if turnID == "" {
+		turnID = req.TurnID
+	}
+
+	bodyHash := turnHash(req.UserMessage)
+
+	// mu is only held to read the session and to commit the turn, not across the model call
+	session.mu.Lock()
+	if turnID != "" {
+		if cached, ok := session.TurnResponses[turnID]; ok {
+			session.mu.Unlock()
+			if cached.bodyHash != bodyHash {
+				respondWithJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "Turn id was already used for a different message"})
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			respondWithJSON(w, http.StatusOK, cached.response)
+			return
+		}
+	}
+
+	if !session.IsActive {
+		session.mu.Unlock()
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Session not found or has expired"})
+		return
+	}
+	// one turn at a time per session. a retry sent while the original is still running gets a 409,
+	// sending it again once that is done gets the replay
+	if session.turnInFlight {
+		session.mu.Unlock()
+		respondWithJSON(w, http.StatusConflict, map[string]string{"error": "A turn is already in progress for this session"})
+		return
+	}
+	if cfg.quota.tokensExceeded(session.UserID) {
+		session.mu.Unlock()
+		respondQuotaExceeded(w)
+		return
+	}
+
+	// answering is as good as resuming, the clock runs while they talk
+	answeredAt := time.Now()
+	session.resume(answeredAt)
+	session.LastActivityTime = answeredAt
+
+	turn := &genai.Content{
+		Parts: []genai.Part{genai.Text(req.UserMessage), genai.Text("time remaining : " + strconv.Itoa(int(session.TimeRemaining().Seconds())) + " seconds")},
 		Role:  "user",
-	})
-	session.LastActivityTime = time.Now()
+	}
+	// nothing else changes the history while turnInFlight is set, the copy stays current
+	history := session.ChatHistory
+	contextTokens := session.ContextTokens
+	session.turnInFlight = true
+	session.mu.Unlock()
+
+	// summarizing is best effort, the turn still works with the full history
+	compacted, err := cfg.compactHistory(r.Context(), session, history, contextTokens)
+	if err != nil {
+		slog.WarnContext(r.Context(), "could not compact history", "error", err)
+	}
+	if compacted != nil {
+		history = compacted
+	}
+	llmResponse, usage, err := cfg.generateResponse(r.Context(), history, turn)
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.turnInFlight = false
 
-	llmResponse, err := cfg.generateResponse(r.Context(), session)
 	if err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, ChatResponse{Error: err.Error()})
 		return
 	}
+	// a failed turn leaves the history as it was, summary included, the retry compacts again
+	if compacted != nil {
+		session.ChatHistory = compacted
+		// the next turn measures it again
+		session.ContextTokens = 0
+	}
+	recordUsage(session.UserID, session, tokenUsage(usage))
+	if usage != nil {
+		session.ContextTokens = int(usage.TotalTokenCount)
+	}
 
-	session.ChatHistory = append(session.ChatHistory, &genai.Content{
+	// history only changes once the turn went through, so the client can just send it again
+	session.ChatHistory = append(session.ChatHistory, turn, &genai.Content{
 		Parts: []genai.Part{genai.Text(llmResponse)},
 		Role:  "model",
 	})
+	session.addMessage(roleCandidate, req.UserMessage, answeredAt)
+	session.addMessage(roleInterviewer, llmResponse, time.Now())
+
+	resp := ChatResponse{Message: llmResponse}
+	if turnID != "" {
+		session.rememberTurn(turnID, bodyHash, resp, time.Now())
+	}
 
-	respondWithJSON(w, http.StatusOK, ChatResponse{Message: llmResponse})
+	respondWithJSON(w, http.StatusOK, resp)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	response, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %v", err)
+		slog.Error("error marshalling JSON", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`{"error": "Internal server error"}`))
 		return
@@ -240,13 +619,29 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 }
 
 func (cfg *config) sttHandler(w http.ResponseWriter, r *http.Request) {
-	//10 mb
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.sttMaxUpload)
+	//10 mb in memory, the rest goes to temp files
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithJSON(w, http.StatusRequestEntityTooLarge, SttResponse{Error: "Audio file is too large"})
+			return
+		}
 		respondWithJSON(w, http.StatusBadRequest, SttResponse{Error: "Could not parse form"})
 		return
 	}
 
-	file, _, err := r.FormFile("audio")
+	uid := userID(r)
+	if cfg.quota.audioExceeded(uid) {
+		respondQuotaExceeded(w)
+		return
+	}
+	session := lookupSession(r.FormValue("sessionId"))
+	if session != nil {
+		setRequestSessionID(r.Context(), session.ID)
+	}
+
+	file, header, err := r.FormFile("audio")
 	if err != nil {
 		respondWithJSON(w, http.StatusBadRequest, SttResponse{Error: "Form file 'audio' is required"})
 		return
@@ -259,39 +654,146 @@ func (cfg *config) sttHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	transcript, err := cfg.convertSpeechToText(r.Context(), audioData)
+	audio, err := cfg.prepareAudio(r.Context(), audioData, header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithJSON(w, http.StatusUnsupportedMediaType, SttResponse{Error: err.Error() + ", send webm or ogg opus, wav, flac or mp3"})
+		return
+	}
+
+	// long answers take a while, clients asking for ndjson get a progress line per finished segment
+	// and the usual response as the last line
+	if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		cfg.sttProgressStream(w, r, uid, session, audio)
+		return
+	}
+
+	transcript, billed, err := cfg.convertSpeechToText(r.Context(), audio, session.vocabulary(), nil)
+	recordUsage(uid, session, Usage{SttAudioSeconds: billed.Seconds()})
 	if err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, SttResponse{Error: "Failed to process audio"})
 		return
 	}
+	recordSpeaking(session, transcript)
 
-	respondWithJSON(w, http.StatusOK, SttResponse{Text: transcript})
+	respondWithJSON(w, http.StatusOK, SttResponse{Transcript: transcript})
 }
 
-func (cfg *config) ttsHandler(w http.ResponseWriter, r *http.Request) {
-	var req TtsRequest
+func (cfg *config) sttProgressStream(w http.ResponseWriter, r *http.Request, uid string, session *ChatSession, audio *audioInput) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	transcript, billed, err := cfg.convertSpeechToText(r.Context(), audio, session.vocabulary(), func(p sttProgress) {
+		enc.Encode(p)
+		rc.Flush()
+	})
+	recordUsage(uid, session, Usage{SttAudioSeconds: billed.Seconds()})
+	if err != nil {
+		enc.Encode(SttResponse{Error: "Failed to process audio"})
+		return
+	}
+	recordSpeaking(session, transcript)
+	enc.Encode(SttResponse{Transcript: transcript})
+}
+
+// decodeTtsRequest reads a /tts or /tts/stream body and works out the voice, writing the error response itself when it fails.
+func decodeTtsRequest(w http.ResponseWriter, r *http.Request) (req TtsRequest, session *ChatSession, voice VoiceSettings, ok bool) {
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
-		return
+		return req, nil, voice, false
 	}
 	if req.Text == "" {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Text cannot be empty"})
+		return req, nil, voice, false
+	}
+
+	session = lookupSession(req.SessionID)
+	if session != nil {
+		setRequestSessionID(r.Context(), session.ID)
+	}
+
+	if req.Voice != nil {
+		if err := req.Voice.validate(); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return req, session, voice, false
+		}
+		voice = *req.Voice
+	}
+	return req, session, voice.merge(session.voice()), true
+}
+
+func (cfg *config) ttsHandler(w http.ResponseWriter, r *http.Request) {
+	req, session, voice, ok := decodeTtsRequest(w, r)
+	if !ok {
+		return
+	}
+
+	encoding, ok := negotiateEncoding(r.Header.Get("Accept"), cfg.tts.Encodings())
+	if !ok {
+		notAcceptable(w, cfg.tts.Encodings())
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	// a cache hit costs google nothing, so it doesnt count against the quota either
+	key := ttsCacheKey(cfg.ttsBackend, req.Text, voice, encoding)
+	if audioData, cached, ok := cfg.ttsCache.get(r.Context(), key); ok {
+		cfg.serveTtsAudio(w, r, key, audioData, cached)
 		return
 	}
 
-	audioData, err := cfg.convertTextToSpeech(r.Context(), req.Text)
+	uid := userID(r)
+	chars := int64(utf8.RuneCountInString(req.Text))
+	if cfg.quota.ttsCharsExceeded(uid, chars) {
+		respondQuotaExceeded(w)
+		return
+	}
+
+	audioData, err := cfg.convertTextToSpeech(r.Context(), req.Text, voice, encoding)
 	if err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to generate audio"})
 		return
 	}
-	//for streaming
-	w.Header().Set("Content-Type", "audio/mpeg")
-	w.Header().Set("Content-Length", strconv.Itoa(len(audioData)))
-	w.Header().Set("Accept-Ranges", "bytes")
+	recordUsage(uid, session, Usage{TtsCharacters: chars})
+	cfg.ttsCache.put(r.Context(), key, audioData, encoding)
 
-	w.WriteHeader(http.StatusOK)
+	cfg.serveTtsAudio(w, r, key, audioData, encoding)
+}
+
+func (cfg *config) serveTtsAudio(w http.ResponseWriter, r *http.Request, key string, audio []byte, encoding ttsEncoding) {
+	if cfg.ttsCache != nil {
+		// where GET /tts/{key} serves the same audio, for <audio> elements that want a url
+		w.Header().Set("Content-Location", "/tts/"+key)
+	}
+	serveAudio(w, r, key, audio, encoding)
+}
 
-	w.Write(audioData)
+// lookupSession returns nil for unknown or empty ids, for endpoints where the session is optional.
+func lookupSession(id string) *ChatSession {
+	if id == "" {
+		return nil
+	}
+	sessionsMutex.RLock()
+	defer sessionsMutex.RUnlock()
+	return chatSessions[id]
+}
+
+// voice is safe to call on a nil session, /tts works without one.
+func (cs *ChatSession) voice() VoiceSettings {
+	if cs == nil {
+		return defaultVoice
+	}
+	return cs.Voice
+}
+
+// vocabulary is safe to call on a nil session, /stt works without one.
+func (cs *ChatSession) vocabulary() []string {
+	if cs == nil {
+		return nil
+	}
+	return cs.Vocabulary
 }
 
 func isURL(str string) bool {
@@ -300,11 +802,11 @@ func isURL(str string) bool {
 }
 
 func (cs *ChatSession) IsTimeExceeded() bool {
-	return time.Since(cs.StartTime) > time.Duration(cs.TimeLimitSeconds)*time.Second
+	return cs.elapsed(time.Now()) > time.Duration(cs.TimeLimitSeconds)*time.Second
 }
 
 func (cs *ChatSession) TimeRemaining() time.Duration {
-	elapsed := time.Since(cs.StartTime)
+	elapsed := cs.elapsed(time.Now())
 	remaining := time.Duration(cs.TimeLimitSeconds)*time.Second - elapsed
 	if remaining < 0 {
 		return 0
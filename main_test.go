@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+func chatRequest(sessionID, turnID, message string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/chat/"+sessionID, strings.NewReader(`{"userMessage":"`+message+`"}`))
+	r.SetPathValue("sessionId", sessionID)
+	if turnID != "" {
+		r.Header.Set("Idempotency-Key", turnID)
+	}
+	return r
+}
+
+func TestChatHandlerTurns(t *testing.T) {
+	cfg := &config{}
+	session := addTestSession(t, &ChatSession{ID: "chat-test", StartTime: time.Now(), TimeLimitSeconds: 600, IsActive: true})
+	session.rememberTurn("turn-1", turnHash("hello"), ChatResponse{Message: "hi there"}, time.Now())
+
+	tests := []struct {
+		name         string
+		turnID       string
+		message      string
+		inFlight     bool
+		wantCode     int
+		wantReplayed bool
+	}{
+		{name: "replay", turnID: "turn-1", message: "hello", wantCode: http.StatusOK, wantReplayed: true},
+		{name: "replay wins over a turn in flight", turnID: "turn-1", message: "hello", inFlight: true, wantCode: http.StatusOK, wantReplayed: true},
+		{name: "same turn id, other message", turnID: "turn-1", message: "goodbye", wantCode: http.StatusUnprocessableEntity},
+		{name: "turn in flight", turnID: "turn-2", message: "hello", inFlight: true, wantCode: http.StatusConflict},
+		{name: "turn in flight without turn id", message: "hello", inFlight: true, wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session.turnInFlight = tt.inFlight
+			defer func() { session.turnInFlight = false }()
+
+			w := httptest.NewRecorder()
+			cfg.chatHandler(w, chatRequest(session.ID, tt.turnID, tt.message))
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed && !strings.Contains(w.Body.String(), "hi there") {
+				t.Errorf("body = %s, want the cached reply", w.Body)
+			}
+		})
+	}
+}
+
+func TestRememberTurnKeepsTheNewest(t *testing.T) {
+	session := &ChatSession{TurnResponses: make(map[string]turnResponse)}
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range maxTurnResponses + 5 {
+		session.rememberTurn("turn-"+strconv.Itoa(i), turnHash("m"), ChatResponse{Message: strconv.Itoa(i)}, start.Add(time.Duration(i)*time.Second))
+	}
+	if len(session.TurnResponses) != maxTurnResponses {
+		t.Fatalf("kept %d turns, want %d", len(session.TurnResponses), maxTurnResponses)
+	}
+	for i := range 5 {
+		if _, ok := session.TurnResponses["turn-"+strconv.Itoa(i)]; ok {
+			t.Errorf("turn-%d should have been dropped", i)
+		}
+	}
+	if _, ok := session.TurnResponses["turn-"+strconv.Itoa(maxTurnResponses+4)]; !ok {
+		t.Error("newest turn was dropped")
+	}
+}
+
+func TestChatHandlerCompactsOnlyWhenTheTurnWorks(t *testing.T) {
+	tests := []struct {
+		name        string
+		replies     []fakeReply
+		wantCode    int
+		wantHistory []string
+	}{
+		{
+			name:        "turn goes through",
+			replies:     []fakeReply{{text: "summary"}, {text: "why shard?", tokens: 500}},
+			wantCode:    http.StatusOK,
+			wantHistory: []string{"article", "design it", summaryPrefix + "summary", "Got it, let's continue from there.", "answer 2", "reply 2", "shard it", "why shard?"},
+		},
+		{
+			name:        "model fails",
+			replies:     []fakeReply{{text: "summary"}, {err: errors.New("model down")}},
+			wantCode:    http.StatusInternalServerError,
+			wantHistory: []string{"article", "design it", "answer 0", "reply 0", "answer 1", "reply 1", "answer 2", "reply 2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeModelConfig(&fakeModel{replies: tt.replies})
+			cfg.model.contextTokenBudget = 1000
+			cfg.model.keepRecentTurns = 1
+			session := addTestSession(t, &ChatSession{
+				ID:               "chat-compact-test",
+				StartTime:        time.Now(),
+				TimeLimitSeconds: 600,
+				IsActive:         true,
+				ChatHistory:      testHistory(3),
+				ContextTokens:    2000,
+			})
+
+			w := httptest.NewRecorder()
+			cfg.chatHandler(w, chatRequest(session.ID, "", "shard it"))
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			var got []string
+			for _, c := range session.ChatHistory {
+				got = append(got, string(c.Parts[0].(genai.Text)))
+			}
+			if !slices.Equal(got, tt.wantHistory) {
+				t.Errorf("history = %q, want %q", got, tt.wantHistory)
+			}
+			if session.turnInFlight {
+				t.Error("turn still marked in flight")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sdbro_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "method", "status"})
+
+	modelCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sdbro_model_call_duration_seconds",
+		Help:    "Latency of single model calls, retries are counted separately.",
+		Buckets: []float64{.25, .5, 1, 2, 4, 8, 15, 30},
+	}, []string{"model", "outcome"})
+
+	modelTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdbro_model_tokens_total",
+		Help: "Tokens used by model calls.",
+	}, []string{"model", "type"})
+
+	speechDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sdbro_speech_duration_seconds",
+		Help:    "Latency of speech-to-text and text-to-speech calls.",
+		Buckets: []float64{.1, .25, .5, 1, 2, 4, 8, 15},
+	}, []string{"service", "outcome"})
+
+	speechBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdbro_speech_audio_bytes_total",
+		Help: "Audio bytes sent to speech-to-text and returned by text-to-speech.",
+	}, []string{"service"})
+
+	ttsCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdbro_tts_cache_lookups_total",
+		Help: "Text-to-speech cache lookups by where the audio was found.",
+	}, []string{"result"})
+
+	articleCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdbro_article_cache_lookups_total",
+		Help: "Article cache lookups by outcome: hit, revalidated, changed, stale, miss, or shared with a load already running.",
+	}, []string{"result"})
+
+	sessionsEnded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdbro_sessions_ended_total",
+		Help: "Sessions ended, by reason.",
+	}, []string{"reason"})
+
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sdbro_errors_total",
+		Help: "Errors by cause.",
+	}, []string{"cause"})
+)
+
+// error causes for errorsTotal
+const (
+	causeModelCall     = "model_call"
+	causeModelResponse = "model_response"
+	causeSummary       = "history_summary"
+	causeSpeechToText  = "stt"
+	causeTextToSpeech  = "tts"
+	causeQuotaExceeded = "quota_exceeded"
+	causeRateLimited   = "rate_limited"
+	causeLimiterStore  = "limiter_store"
+	causeArticleFetch  = "article_fetch"
+)
+
+func init() {
+	prometheus.MustRegister(sessionCollector{
+		desc: prometheus.NewDesc("sdbro_sessions", "Chat sessions held in memory by state.", []string{"state"}, nil),
+	})
+}
+
+// sessionCollector counts the session map on every scrape instead of keeping a gauge in sync with it.
+type sessionCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	var active, paused, expired int
+	now := time.Now()
+
+	sessionsMutex.RLock()
+	sessions := make([]*ChatSession, 0, len(chatSessions))
+	for _, s := range chatSessions {
+		sessions = append(sessions, s)
+	}
+	sessionsMutex.RUnlock()
+
+	for _, s := range sessions {
+		// the clock fields change under mu, which is only held briefly now that model calls run outside it
+		s.mu.Lock()
+		state := s.state(now).State
+		s.mu.Unlock()
+		switch state {
+		case stateActive:
+			active++
+		case statePaused:
+			paused++
+		default:
+			expired++
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(active), "active")
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(paused), "paused")
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(expired), "expired")
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func observeSpeech(service string, start time.Time, err error) {
+	speechDuration.WithLabelValues(service, outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// httpMetrics records latency per route pattern, so /chat/{sessionId} is one series and not one per session.
+func httpMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// run with -race, a scrape reads the same clock fields pause and resume write
+func TestSessionCollectorWithConcurrentPauses(t *testing.T) {
+	cfg := &config{maxPause: time.Minute}
+	session := addTestSession(t, &ChatSession{ID: "collector-test", StartTime: time.Now(), TimeLimitSeconds: 600, IsActive: true})
+	collector := sessionCollector{desc: prometheus.NewDesc("test_sessions", "test", []string{"state"}, nil)}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			cfg.pauseHandler(discardResponse{}, sessionRequest(http.MethodPost, "/session/collector-test/pause", session.ID))
+			cfg.resumeHandler(discardResponse{}, sessionRequest(http.MethodPost, "/session/collector-test/resume", session.ID))
+		}
+	}()
+	for range 50 {
+		ch := make(chan prometheus.Metric, 3)
+		collector.Collect(ch)
+		close(ch)
+		if len(ch) != 3 {
+			t.Fatalf("collected %d series, want 3", len(ch))
+		}
+	}
+	wg.Wait()
+}
+
+type discardResponse struct{}
+
+func (discardResponse) Header() http.Header         { return http.Header{} }
+func (discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponse) WriteHeader(int)             {}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// rateLimit is a token bucket: burst requests at once, refilled at perMinute.
+type rateLimit struct {
+	perMinute float64
+	burst     int
+}
+
+func (l rateLimit) perSecond() float64 {
+	return l.perMinute / 60
+}
+
+// LimiterStore holds the buckets. the in memory store works for a single instance,
+// something redis backed can implement the same interface once we run more than one.
+type LimiterStore interface {
+	// Take spends one token from the bucket at key. when it is empty it returns false
+	// and how long until the next token is available.
+	Take(ctx context.Context, key string, limit rateLimit, now time.Time) (bool, time.Duration, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  rateLimit
+}
+
+type memoryLimiterStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newMemoryLimiterStore() *memoryLimiterStore {
+	return &memoryLimiterStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *memoryLimiterStore) Take(ctx context.Context, key string, limit rateLimit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.burst), last: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	if limit.perSecond() <= 0 {
+		return false, time.Hour, nil
+	}
+	wait := time.Duration((1 - b.tokens) / limit.perSecond() * float64(time.Second))
+	return false, wait, nil
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(float64(b.limit.burst), b.tokens+elapsed*b.limit.perSecond())
+	b.last = now
+}
+
+// sweep drops buckets that have refilled completely, they are the same as a new one.
+// runs at most once a minute. callers hold s.mu.
+func (s *memoryLimiterStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+type rateLimiter struct {
+	store LimiterStore
+	clock clock
+}
+
+// limit wraps next with a per user (or ip) bucket for the named endpoint, so
+// each endpoint has its own budget.
+func (rl *rateLimiter) limit(name string, limit rateLimit, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := name + ":" + userID(r)
+		ok, retryAfter, err := rl.store.Take(r.Context(), key, limit, rl.clock.Now())
+		if err != nil {
+			// a broken limiter store shouldnt take the whole api down with it
+			errorsTotal.WithLabelValues(causeLimiterStore).Inc()
+			slog.ErrorContext(r.Context(), "rate limiter store failed, letting the request through", "key", key, "error", err)
+			next(w, r)
+			return
+		}
+		if !ok {
+			errorsTotal.WithLabelValues(causeRateLimited).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			respondWithJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many requests, slow down"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// envRateLimit reads RATE_LIMIT_<NAME>_PER_MINUTE and RATE_LIMIT_<NAME>_BURST.
+func envRateLimit(name string, perMinute, burst int) rateLimit {
+	l := rateLimit{
+		perMinute: float64(envInt(fmt.Sprintf("RATE_LIMIT_%s_PER_MINUTE", name), perMinute)),
+		burst:     envInt(fmt.Sprintf("RATE_LIMIT_%s_BURST", name), burst),
+	}
+	if l.burst < 1 {
+		fatal("rate limit burst must be at least 1", "env", fmt.Sprintf("RATE_LIMIT_%s_BURST", name))
+	}
+	return l
+}
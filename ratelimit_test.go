@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestMemoryLimiterStoreTake(t *testing.T) {
+	limit := rateLimit{perMinute: 60, burst: 3}
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	store := newMemoryLimiterStore()
+
+	take := func() (bool, time.Duration) {
+		t.Helper()
+		ok, wait, err := store.Take(context.Background(), "key", limit, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok, wait
+	}
+
+	for i := range limit.burst {
+		if ok, _ := take(); !ok {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	ok, wait := take()
+	if ok {
+		t.Fatal("request past the burst went through")
+	}
+	if wait != time.Second {
+		t.Errorf("wait = %v, want 1s at 60 per minute", wait)
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, wait := take(); ok || wait != 500*time.Millisecond {
+		t.Errorf("half refilled: ok = %v, wait = %v, want refused with 500ms", ok, wait)
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, _ := take(); !ok {
+		t.Error("refilled token was refused")
+	}
+	if ok, _ := take(); ok {
+		t.Error("only one token should have refilled")
+	}
+
+	// refilling stops at the burst
+	clock.advance(time.Hour)
+	for i := range limit.burst {
+		if ok, _ := take(); !ok {
+			t.Fatalf("request %d after a long pause was refused", i+1)
+		}
+	}
+	if ok, _ := take(); ok {
+		t.Error("bucket refilled past the burst")
+	}
+}
+
+func TestMemoryLimiterStoreSweepsFullBuckets(t *testing.T) {
+	limit := rateLimit{perMinute: 60, burst: 2}
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	store := newMemoryLimiterStore()
+
+	store.Take(context.Background(), "a", limit, clock.Now())
+	store.Take(context.Background(), "b", limit, clock.Now())
+	clock.advance(2 * time.Minute)
+	store.Take(context.Background(), "c", limit, clock.Now())
+
+	if _, ok := store.buckets["a"]; ok {
+		t.Error("full bucket a was not swept")
+	}
+	if _, ok := store.buckets["c"]; !ok {
+		t.Error("bucket c was swept right after use")
+	}
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	rl := &rateLimiter{store: newMemoryLimiterStore(), clock: clock}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	// 6 per minute, a token every 10s
+	limit := rateLimit{perMinute: 6, burst: 1}
+	chat := rl.limit("chat", limit, ok)
+	stt := rl.limit("stt", limit, ok)
+
+	call := func(h http.HandlerFunc, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := call(chat, "192.0.2.1"); w.Code != http.StatusOK {
+		t.Fatalf("first request: %d", w.Code)
+	}
+	w := call(chat, "192.0.2.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, want 10", got)
+	}
+
+	clock.advance(3500 * time.Millisecond)
+	// rounded up, 6.5s left is 7 and never 6
+	if got := call(chat, "192.0.2.1").Header().Get("Retry-After"); got != "7" {
+		t.Errorf("Retry-After = %q, want 7", got)
+	}
+
+	// every route and every user has a bucket of its own
+	if w := call(stt, "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("other route: %d, want 200", w.Code)
+	}
+	if w := call(chat, "192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("other user: %d, want 200", w.Code)
+	}
+
+	clock.advance(10 * time.Second)
+	if w := call(chat, "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("after the refill: %d, want 200", w.Code)
+	}
+}
+
+// an untrusted X-User-ID must not buy a fresh bucket
+func TestRateLimiterIgnoresUserIDHeader(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	rl := &rateLimiter{store: newMemoryLimiterStore(), clock: clock}
+	h := rl.limit("chat", rateLimit{perMinute: 6, burst: 1}, func(w http.ResponseWriter, r *http.Request) {})
+
+	codes := make([]int, 2)
+	for i, id := range []string{"user-a", "user-b"} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-User-ID", id)
+		w := httptest.NewRecorder()
+		h(w, r)
+		codes[i] = w.Code
+	}
+	if codes[1] != http.StatusTooManyRequests {
+		t.Errorf("second request with a new X-User-ID: %d, want 429", codes[1])
+	}
+}
+
+// nor does a made up X-Forwarded-For when there is no proxy in front
+func TestRateLimiterIgnoresForwardedForWithoutProxy(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	rl := &rateLimiter{store: newMemoryLimiterStore(), clock: clock}
+	h := rl.limit("chat", rateLimit{perMinute: 6, burst: 1}, func(w http.ResponseWriter, r *http.Request) {})
+
+	codes := make([]int, 2)
+	for i, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-Forwarded-For", ip)
+		w := httptest.NewRecorder()
+		h(w, r)
+		codes[i] = w.Code
+	}
+	if codes[1] != http.StatusTooManyRequests {
+		t.Errorf("second request with a new X-Forwarded-For: %d, want 429", codes[1])
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/speech/apiv1p1beta1/speechpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// synchronous Recognize takes about a minute of audio, a bit under it to be safe
+	syncRecognizeLimit = 55 * time.Second
+	// google wants stream requests under 25KB
+	streamChunkSize = 25 << 10
+)
+
+// recognizer is the part of the speech api we use. it is an interface so a fake can stand in for google.
+type recognizer interface {
+	Recognize(ctx context.Context, req *speechpb.RecognizeRequest) (*speechpb.RecognizeResponse, error)
+	// StreamRecognize sends the chunks in order and calls onResponse for every response, in order.
+	StreamRecognize(ctx context.Context, config *speechpb.StreamingRecognitionConfig, chunks [][]byte, onResponse func(*speechpb.StreamingRecognizeResponse)) error
+	Close() error
+}
+
+type googleRecognizer struct {
+	client *speech.Client
+}
+
+func newGoogleRecognizer(ctx context.Context) (recognizer, error) {
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return googleRecognizer{client: client}, nil
+}
+
+func (g googleRecognizer) Recognize(ctx context.Context, req *speechpb.RecognizeRequest) (*speechpb.RecognizeResponse, error) {
+	return g.client.Recognize(ctx, req)
+}
+
+func (g googleRecognizer) StreamRecognize(ctx context.Context, config *speechpb.StreamingRecognitionConfig, chunks [][]byte, onResponse func(*speechpb.StreamingRecognizeResponse)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := g.client.StreamingRecognize(ctx)
+	if err != nil {
+		return err
+	}
+
+	// send everything from a goroutine while the results are read here, google starts answering before the upload is done
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- func() error {
+			if err := stream.Send(&speechpb.StreamingRecognizeRequest{
+				StreamingRequest: &speechpb.StreamingRecognizeRequest_StreamingConfig{StreamingConfig: config},
+			}); err != nil {
+				return err
+			}
+			for _, chunk := range chunks {
+				if err := stream.Send(&speechpb.StreamingRecognizeRequest{
+					StreamingRequest: &speechpb.StreamingRecognizeRequest_AudioContent{AudioContent: chunk},
+				}); err != nil {
+					return err
+				}
+			}
+			return stream.CloseSend()
+		}()
+	}()
+
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("streaming recognition: %s", resp.Error.Message)
+		}
+		onResponse(resp)
+	}
+
+	// io.EOF from Send just means the server closed first, Recv has the real error then
+	if err := <-sendErr; err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (g googleRecognizer) Close() error {
+	return g.client.Close()
+}
+
+// sttProgress is reported while a long answer is being transcribed.
+type sttProgress struct {
+	// 0..1 by audio time, missing when the length of the upload is not known
+	Progress *float64 `json:"progress,omitempty"`
+	Text     string   `json:"text"`
+}
+
+// streamRecognize transcribes audio that is too long for Recognize, stitching the final results in order.
+func streamRecognize(ctx context.Context, rec recognizer, config *speechpb.RecognitionConfig, audio *audioInput, progress func(sttProgress)) ([]*speechpb.SpeechRecognitionResult, time.Duration, error) {
+	var results []*speechpb.SpeechRecognitionResult
+	var billed time.Duration
+	var texts []string
+
+	err := rec.StreamRecognize(ctx,
+		&speechpb.StreamingRecognitionConfig{Config: config},
+		chunkAudio(audio.data, streamChunkSize),
+		func(resp *speechpb.StreamingRecognizeResponse) {
+			if resp.TotalBilledTime != nil {
+				billed = resp.TotalBilledTime.AsDuration()
+			}
+			for _, result := range resp.Results {
+				if !result.IsFinal || len(result.Alternatives) == 0 {
+					continue
+				}
+				// same shape as the sync api so the transcript is built the same way
+				results = append(results, &speechpb.SpeechRecognitionResult{
+					Alternatives:  result.Alternatives,
+					ChannelTag:    result.ChannelTag,
+					ResultEndTime: result.ResultEndTime,
+					LanguageCode:  result.LanguageCode,
+				})
+				texts = append(texts, strings.TrimSpace(result.Alternatives[0].Transcript))
+
+				if progress != nil {
+					progress(sttProgress{
+						Progress: streamProgress(result.GetResultEndTime().AsDuration(), audio.duration),
+						Text:     strings.Join(texts, " "),
+					})
+				}
+			}
+		},
+	)
+	if err != nil {
+		return nil, billed, err
+	}
+	return results, billed, nil
+}
+
+// streamProgress is nil when the length is unknown, a made up number would only jump around.
+func streamProgress(done, total time.Duration) *float64 {
+	if total <= 0 {
+		return nil
+	}
+	p := min(done.Seconds()/total.Seconds(), 1)
+	return &p
+}
+
+func chunkAudio(data []byte, size int) [][]byte {
+	chunks := make([][]byte, 0, len(data)/size+1)
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	if len(data) > 0 {
+		chunks = append(chunks, data)
+	}
+	return chunks
+}
+
+// isAudioTooLong is how Recognize rejects audio past its limit, for the formats where we cannot tell the length upfront.
+func isAudioTooLong(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.InvalidArgument && strings.Contains(strings.ToLower(s.Message()), "too long")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/speech/apiv1p1beta1/speechpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// fakeRecognizer answers Recognize with recognizeErr or recognizeResults and StreamRecognize
+// with the canned responses, recording what it was sent.
+type fakeRecognizer struct {
+	recognizeResults []*speechpb.SpeechRecognitionResult
+	recognizeErr     error
+	responses        []*speechpb.StreamingRecognizeResponse
+	streamErr        error
+
+	recognizeCalls int
+	streamCalls    int
+	chunks         [][]byte
+}
+
+func (f *fakeRecognizer) Recognize(ctx context.Context, req *speechpb.RecognizeRequest) (*speechpb.RecognizeResponse, error) {
+	f.recognizeCalls++
+	if f.recognizeErr != nil {
+		return nil, f.recognizeErr
+	}
+	return &speechpb.RecognizeResponse{Results: f.recognizeResults}, nil
+}
+
+func (f *fakeRecognizer) StreamRecognize(ctx context.Context, config *speechpb.StreamingRecognitionConfig, chunks [][]byte, onResponse func(*speechpb.StreamingRecognizeResponse)) error {
+	f.streamCalls++
+	f.chunks = chunks
+	for _, resp := range f.responses {
+		onResponse(resp)
+	}
+	return f.streamErr
+}
+
+func (f *fakeRecognizer) Close() error { return nil }
+
+func streamResult(text string, final bool, end time.Duration) *speechpb.StreamingRecognitionResult {
+	return &speechpb.StreamingRecognitionResult{
+		Alternatives:  []*speechpb.SpeechRecognitionAlternative{{Transcript: text, Confidence: 0.9}},
+		IsFinal:       final,
+		ResultEndTime: durationpb.New(end),
+	}
+}
+
+// three final segments, with interim results in between that must not end up in the transcript
+func streamResponses() []*speechpb.StreamingRecognizeResponse {
+	return []*speechpb.StreamingRecognizeResponse{
+		{Results: []*speechpb.StreamingRecognitionResult{streamResult("first we shard", false, 10*time.Second)}},
+		{Results: []*speechpb.StreamingRecognitionResult{streamResult("first we shard by user", true, 20*time.Second)}},
+		{Results: []*speechpb.StreamingRecognitionResult{
+			streamResult("then a cache", true, 40*time.Second),
+			streamResult("in front", false, 50*time.Second),
+		}},
+		{
+			Results:         []*speechpb.StreamingRecognitionResult{streamResult("in front of it", true, 80*time.Second)},
+			TotalBilledTime: durationpb.New(90 * time.Second),
+		},
+	}
+}
+
+func TestStreamRecognizeStitchesInOrder(t *testing.T) {
+	audio := &audioInput{data: bytes.Repeat([]byte{1, 2, 3}, streamChunkSize), duration: 80 * time.Second}
+	rec := &fakeRecognizer{responses: streamResponses()}
+
+	var updates []sttProgress
+	results, billed, err := streamRecognize(context.Background(), rec, &speechpb.RecognitionConfig{}, audio, func(p sttProgress) {
+		updates = append(updates, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.chunks) != 3 {
+		t.Errorf("sent %d chunks, want 3", len(rec.chunks))
+	}
+	for i, c := range rec.chunks {
+		if len(c) > streamChunkSize {
+			t.Errorf("chunk %d is %d bytes, over the %d limit", i, len(c), streamChunkSize)
+		}
+	}
+	if !bytes.Equal(bytes.Join(rec.chunks, nil), audio.data) {
+		t.Error("chunks do not add up to the audio in order")
+	}
+
+	if billed != 90*time.Second {
+		t.Errorf("billed = %v, want 90s", billed)
+	}
+	if got := buildTranscript(results, 0).Text; got != "first we shard by user then a cache in front of it" {
+		t.Errorf("transcript = %q", got)
+	}
+
+	wantProgress := []float64{0.25, 0.5, 1}
+	if len(updates) != len(wantProgress) {
+		t.Fatalf("got %d progress updates, want one per final segment", len(updates))
+	}
+	for i, u := range updates {
+		if u.Progress == nil || *u.Progress != wantProgress[i] {
+			t.Errorf("update %d progress = %v, want %v", i, u.Progress, wantProgress[i])
+		}
+	}
+	if updates[1].Text != "first we shard by user then a cache" {
+		t.Errorf("update 1 text = %q, want the text so far", updates[1].Text)
+	}
+}
+
+func TestStreamRecognizeUnknownLength(t *testing.T) {
+	rec := &fakeRecognizer{responses: streamResponses()}
+	var updates []sttProgress
+	_, _, err := streamRecognize(context.Background(), rec, &speechpb.RecognitionConfig{}, &audioInput{data: []byte{1}}, func(p sttProgress) {
+		updates = append(updates, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, u := range updates {
+		if u.Progress != nil {
+			t.Errorf("update %d reports progress %v without knowing the length", i, *u.Progress)
+		}
+	}
+}
+
+func TestGoogleSpeechToTextTranscribe(t *testing.T) {
+	syncResults := []*speechpb.SpeechRecognitionResult{{
+		Alternatives: []*speechpb.SpeechRecognitionAlternative{{Transcript: "short answer", Confidence: 0.95}},
+	}}
+	tooLong := status.Error(codes.InvalidArgument, "Sync input too long. For audio longer than 1 min use LongRunningRecognize")
+	streamFailed := errors.New("stream broke")
+
+	tests := []struct {
+		name          string
+		duration      time.Duration
+		rec           *fakeRecognizer
+		wantText      string
+		wantErr       bool
+		wantRecognize int
+		wantStreams   int
+	}{
+		{
+			name:     "short audio is recognized in one request",
+			duration: 10 * time.Second,
+			rec:      &fakeRecognizer{recognizeResults: syncResults},
+			wantText: "short answer", wantRecognize: 1,
+		},
+		{
+			name:     "long audio goes straight to streaming",
+			duration: 2 * time.Minute,
+			rec:      &fakeRecognizer{responses: streamResponses()},
+			wantText: "first we shard by user then a cache in front of it", wantStreams: 1,
+		},
+		{
+			name:     "unknown length that turns out too long falls back to streaming",
+			rec:      &fakeRecognizer{recognizeErr: tooLong, responses: streamResponses()},
+			wantText: "first we shard by user then a cache in front of it", wantRecognize: 1, wantStreams: 1,
+		},
+		{
+			name:          "other recognize errors are not retried",
+			rec:           &fakeRecognizer{recognizeErr: status.Error(codes.Unavailable, "down")},
+			wantErr:       true,
+			wantRecognize: 1,
+		},
+		{
+			name:     "stream errors come back",
+			duration: 2 * time.Minute,
+			rec:      &fakeRecognizer{responses: streamResponses()[:2], streamErr: streamFailed},
+			wantErr:  true, wantStreams: 1,
+		},
+		{
+			name:     "nothing recognized",
+			duration: 10 * time.Second,
+			rec:      &fakeRecognizer{},
+			wantErr:  true, wantRecognize: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stt := googleSpeechToText{
+				newRecognizer: func(context.Context) (recognizer, error) { return tt.rec, nil },
+				lowConfidence: 0.7,
+			}
+			audio := &audioInput{data: []byte("audio"), format: "webm", duration: tt.duration}
+			transcript, _, err := stt.Transcribe(context.Background(), audio, nil, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got transcript %q, want an error", transcript.Text)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if transcript.Text != tt.wantText {
+				t.Errorf("text = %q, want %q", transcript.Text, tt.wantText)
+			}
+			if tt.rec.recognizeCalls != tt.wantRecognize || tt.rec.streamCalls != tt.wantStreams {
+				t.Errorf("recognize/stream calls = %d/%d, want %d/%d", tt.rec.recognizeCalls, tt.rec.streamCalls, tt.wantRecognize, tt.wantStreams)
+			}
+		})
+	}
+}
+
+func TestGoogleSpeechToTextRecognizerError(t *testing.T) {
+	stt := googleSpeechToText{newRecognizer: func(context.Context) (recognizer, error) { return nil, errors.New("no credentials") }}
+	if _, _, err := stt.Transcribe(context.Background(), &audioInput{data: []byte("a")}, nil, nil); err == nil {
+		t.Fatal("want an error when the client cannot be created")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/google/uuid"
+)
+
+type RewindRequest struct {
+	// answers to keep, 0 goes back to the opening question
+	Turn int `json:"turn"`
+	// leave this session as it is and continue in a new one that shares the conversation up to Turn
+	Fork bool `json:"fork"`
+}
+
+type RewindResponse struct {
+	SessionState
+	Turn int `json:"turn"`
+	// the interviewer's question the user answers again
+	Question   string `json:"question"`
+	ForkedFrom string `json:"forkedFrom,omitempty"`
+}
+
+func (cfg *config) rewindHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req RewindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if req.Turn < 0 || req.Turn > session.turnCount() {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "'turn' must be between 0 and the number of answers given"})
+		return
+	}
+	// messages go question, answer, reply, answer, reply... so turn n ends with the reply at 2n
+	messages := session.Messages[:2*req.Turn+1]
+	history := rebuildHistory(session.ChatHistory[0], messages)
+	question := messages[len(messages)-1]
+	now := time.Now()
+
+	if !req.Fork {
+		if !session.IsActive {
+			respondWithJSON(w, http.StatusConflict, map[string]string{"error": "Session has ended, fork it instead"})
+			return
+		}
+		// the turn would land on top of the rewound conversation
+		if session.turnInFlight {
+			respondWithJSON(w, http.StatusConflict, map[string]string{"error": "A turn is in progress, rewind once it is answered"})
+			return
+		}
+		session.Messages = slices.Clip(messages)
+		session.ChatHistory = history
+		session.ContextTokens = 0
+		speakingMutex.Lock()
+		session.Speaking = speakingUpTo(session.Speaking, req.Turn)
+		speakingMutex.Unlock()
+		// a retried turn id must not replay the answer that was just thrown away
+		clear(session.TurnResponses)
+		session.LastActivityTime = now
+
+		respondWithJSON(w, http.StatusOK, RewindResponse{
+			SessionState: session.state(now),
+			Turn:         req.Turn,
+			Question:     question.Text,
+		})
+		return
+	}
+
+	// the fork picks the clock up where it was when that question was asked. pauses since
+	// then are not tracked one by one, so it can only come out with less time, never more
+	elapsedAt := min(question.Time.Sub(session.StartTime), session.elapsed(now))
+	speakingMutex.Lock()
+	speaking := speakingUpTo(session.Speaking, req.Turn)
+	speakingMutex.Unlock()
+
+	fork := &ChatSession{
+		ID:               uuid.New().String(),
+		UserID:           session.UserID,
+		ChatHistory:      history,
+		Messages:         slices.Clone(messages),
+		ArticleURL:       session.ArticleURL,
+		ArticleURLs:      session.ArticleURLs,
+		Topic:            session.Topic,
+		Persona:          session.Persona,
+		StartTime:        now.Add(-elapsedAt),
+		TimeLimitSeconds: session.TimeLimitSeconds,
+		IsActive:         true,
+		LastActivityTime: now,
+		Vocabulary:       session.Vocabulary,
+		Voice:            session.Voice,
+		Speaking:         speaking,
+		TurnResponses:    make(map[string]turnResponse),
+		ForkedFrom:       session.ID,
+	}
+	sessionsMutex.Lock()
+	chatSessions[fork.ID] = fork
+	sessionsMutex.Unlock()
+
+	respondWithJSON(w, http.StatusCreated, RewindResponse{
+		SessionState: fork.state(now),
+		Turn:         req.Turn,
+		Question:     question.Text,
+		ForkedFrom:   session.ID,
+	})
+}
+
+// rebuildHistory turns the visible messages back into model history after the problem statement prompt.
+// summaries and time notes are left out, the next turn measures the context again and compacts if it has to.
+func rebuildHistory(prompt *genai.Content, messages []Message) []*genai.Content {
+	history := make([]*genai.Content, 0, len(messages)+1)
+	history = append(history, prompt)
+	for _, m := range messages {
+		role := "user"
+		if m.Role == roleInterviewer {
+			role = "model"
+		}
+		history = append(history, &genai.Content{Parts: []genai.Part{genai.Text(m.Text)}, Role: role})
+	}
+	return history
+}
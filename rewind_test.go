@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// rewindSession is a session two answers in, with the delivery of both analyzed.
+func rewindSession(t *testing.T, id string) *ChatSession {
+	t.Helper()
+	start := time.Now().Add(-10 * time.Minute)
+	s := &ChatSession{
+		ID:               id,
+		StartTime:        start,
+		TimeLimitSeconds: 3600,
+		IsActive:         true,
+		ChatHistory:      []*genai.Content{{Parts: []genai.Part{genai.Text("prompt")}, Role: "user"}},
+		Speaking: []SpeakingTurn{
+			{Answer: 1, Words: 100, Fillers: map[string]int{"um": 2}},
+			{Answer: 2, Words: 50, Fillers: map[string]int{"like": 1}},
+		},
+	}
+	for i, text := range []string{"design a url shortener", "hash the url", "what about collisions?", "retry with a salt", "and the reads?"} {
+		role := roleInterviewer
+		if i%2 == 1 {
+			role = roleCandidate
+		}
+		s.addMessage(role, text, start.Add(time.Duration(i)*time.Minute))
+	}
+	addTestSession(t, s)
+	s.rememberTurn("turn-2", turnHash("retry with a salt"), ChatResponse{Message: "and the reads?"}, time.Now())
+	return s
+}
+
+func rewindRequest(sessionID, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/session/"+sessionID+"/rewind", strings.NewReader(body))
+	r.SetPathValue("sessionId", sessionID)
+	return r
+}
+
+func TestRewindInPlace(t *testing.T) {
+	session := rewindSession(t, "rewind-test")
+	w := httptest.NewRecorder()
+	(&config{}).rewindHandler(w, rewindRequest(session.ID, `{"turn":1}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("code = %d: %s", w.Code, w.Body)
+	}
+	var resp RewindResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Question != "what about collisions?" {
+		t.Errorf("question = %q", resp.Question)
+	}
+	if len(session.Messages) != 3 || len(session.ChatHistory) != 4 {
+		t.Errorf("kept %d messages and %d history entries, want 3 and 4", len(session.Messages), len(session.ChatHistory))
+	}
+	if len(session.Speaking) != 1 || session.Speaking[0].Answer != 1 {
+		t.Errorf("speaking = %+v, want only the first answer", session.Speaking)
+	}
+	if len(session.TurnResponses) != 0 {
+		t.Error("replays of the discarded answers were kept")
+	}
+	if r := speakingReport(session); r.Answers != 1 || r.TotalWords != 100 {
+		t.Errorf("report counts %d answers and %d words, want 1 and 100", r.Answers, r.TotalWords)
+	}
+}
+
+func TestRewindFork(t *testing.T) {
+	session := rewindSession(t, "rewind-fork-test")
+	session.IsActive = false
+	w := httptest.NewRecorder()
+	(&config{}).rewindHandler(w, rewindRequest(session.ID, `{"turn":1,"fork":true}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("code = %d: %s", w.Code, w.Body)
+	}
+	var resp RewindResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	fork := lookupSession(resp.SessionID)
+	if fork == nil {
+		t.Fatal("fork was not registered")
+	}
+	t.Cleanup(func() {
+		sessionsMutex.Lock()
+		delete(chatSessions, fork.ID)
+		sessionsMutex.Unlock()
+	})
+
+	if fork.ForkedFrom != session.ID || !fork.IsActive {
+		t.Errorf("fork = %+v", fork)
+	}
+	if len(fork.Messages) != 3 || len(fork.Speaking) != 1 {
+		t.Errorf("fork has %d messages and %d speaking turns, want 3 and 1", len(fork.Messages), len(fork.Speaking))
+	}
+	if len(session.Messages) != 5 || len(session.Speaking) != 2 {
+		t.Error("forking changed the original session")
+	}
+	fork.Speaking[0].Fillers["um"]++
+	if session.Speaking[0].Fillers["um"] != 2 {
+		t.Error("fork shares filler counts with the original")
+	}
+}
+
+func TestRewindRefused(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		ended    bool
+		inFlight bool
+		wantCode int
+	}{
+		{name: "turn past the answers given", body: `{"turn":3}`, wantCode: http.StatusBadRequest},
+		{name: "negative turn", body: `{"turn":-1}`, wantCode: http.StatusBadRequest},
+		{name: "bad body", body: `{`, wantCode: http.StatusBadRequest},
+		{name: "ended session in place", body: `{"turn":1}`, ended: true, wantCode: http.StatusConflict},
+		{name: "turn in flight", body: `{"turn":1}`, inFlight: true, wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := rewindSession(t, "rewind-refused-test")
+			session.IsActive = !tt.ended
+			session.turnInFlight = tt.inFlight
+			w := httptest.NewRecorder()
+			(&config{}).rewindHandler(w, rewindRequest(session.ID, tt.body))
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if len(session.Messages) != 5 || len(session.Speaking) != 2 {
+				t.Error("a refused rewind changed the session")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rs/cors"
+)
+
+const (
+	// api responses are json and audio, nothing in them should ever load or be framed
+	defaultContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'; base-uri 'none'"
+	hstsHeader                   = "max-age=63072000; includeSubDomains"
+)
+
+type securityConfig struct {
+	env string
+
+	allowedOrigins []string
+	allowedMethods []string
+	allowedHeaders []string
+
+	contentSecurityPolicy string
+}
+
+func (sc securityConfig) isProduction() bool {
+	return sc.env == "production"
+}
+
+func loadSecurityConfig() securityConfig {
+	sc := securityConfig{
+		env:            envString("APP_ENV", "development"),
+		allowedMethods: envList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "OPTIONS"}),
+		// Authorization is already allowed for the admin endpoints and the auth that comes later
+		allowedHeaders: envList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Accept", "Authorization", "Idempotency-Key", "X-User-ID", "X-Request-ID"}),
+
+		contentSecurityPolicy: envString("CONTENT_SECURITY_POLICY", defaultContentSecurityPolicy),
+	}
+
+	// anything goes locally, production has to list the frontend origins
+	defaultOrigins := []string{"*"}
+	if sc.isProduction() {
+		defaultOrigins = nil
+	}
+	sc.allowedOrigins = envList("CORS_ALLOWED_ORIGINS", defaultOrigins)
+	if sc.isProduction() && len(sc.allowedOrigins) == 0 {
+		fatal("CORS_ALLOWED_ORIGINS environment variable not set")
+	}
+
+	return sc
+}
+
+func (sc securityConfig) cors() *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins:   sc.allowedOrigins,
+		AllowedMethods:   sc.allowedMethods,
+		AllowedHeaders:   sc.allowedHeaders,
+		ExposedHeaders:   []string{"Idempotent-Replayed", "Retry-After", "X-Request-ID"},
+		AllowCredentials: false,
+	})
+}
+
+func (sc securityConfig) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Content-Security-Policy", sc.contentSecurityPolicy)
+		// only over https, locally it would pin localhost to https
+		if sc.isProduction() {
+			h.Set("Strict-Transport-Security", hstsHeader)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// session states as reported to the client
+const (
+	stateActive  = "active"
+	statePaused  = "paused"
+	stateExpired = "expired"
+)
+
+// SessionState is the interview clock, returned by pause and resume.
+type SessionState struct {
+	SessionID        string `json:"sessionId"`
+	State            string `json:"state"`
+	RemainingSeconds int    `json:"remainingSeconds"`
+	PausedSeconds    int    `json:"pausedSeconds"`
+	// when a paused session starts counting again on its own
+	ResumesAt *time.Time `json:"resumesAt,omitempty"`
+	// user_ended, time_expired or idle once the session is over
+	EndReason string `json:"endReason,omitempty"`
+}
+
+// elapsed is the interview time used so far, paused time excluded.
+func (cs *ChatSession) elapsed(now time.Time) time.Duration {
+	// the clock stopped when the session ended
+	if !cs.EndedAt.IsZero() && now.After(cs.EndedAt) {
+		now = cs.EndedAt
+	}
+	return now.Sub(cs.StartTime) - cs.pausedFor(now)
+}
+
+// pausedFor is the paused time so far, including the pause in progress up to its limit.
+func (cs *ChatSession) pausedFor(now time.Time) time.Duration {
+	paused := cs.PausedTotal
+	if !cs.PausedAt.IsZero() {
+		end := now
+		if cs.PauseEndsAt.Before(now) {
+			end = cs.PauseEndsAt
+		}
+		paused += end.Sub(cs.PausedAt)
+	}
+	return paused
+}
+
+// isPaused is false again once a pause ran past the maximum, the clock runs from there.
+func (cs *ChatSession) isPaused(now time.Time) bool {
+	return !cs.PausedAt.IsZero() && now.Before(cs.PauseEndsAt)
+}
+
+// pause stops the clock until resume or until what is left of maxPause runs out. maxPause is for the
+// whole session, pausing and resuming over and over doesnt stop the clock for good. it returns false
+// when there is no pause time left. callers hold mu.
+func (cs *ChatSession) pause(now time.Time, maxPause time.Duration) bool {
+	// pausing twice is fine, the first pause keeps going
+	if cs.isPaused(now) {
+		return true
+	}
+	// a pause that ran out on its own is closed before the new one starts
+	cs.resume(now)
+	budget := maxPause - cs.PausedTotal
+	if budget <= 0 {
+		return false
+	}
+	cs.PausedAt = now
+	cs.PauseEndsAt = now.Add(budget)
+	return true
+}
+
+// resume closes the current pause, if any. callers hold mu.
+func (cs *ChatSession) resume(now time.Time) {
+	if cs.PausedAt.IsZero() {
+		return
+	}
+	cs.PausedTotal = cs.pausedFor(now)
+	cs.PausedAt, cs.PauseEndsAt = time.Time{}, time.Time{}
+}
+
+func (cs *ChatSession) state(now time.Time) SessionState {
+	s := SessionState{
+		SessionID:        cs.ID,
+		State:            stateActive,
+		RemainingSeconds: int(cs.TimeRemaining().Seconds()),
+		PausedSeconds:    int(cs.pausedFor(now).Seconds()),
+		EndReason:        cs.EndReason,
+	}
+	switch {
+	case !cs.IsActive || cs.IsTimeExceeded():
+		s.State = stateExpired
+	case cs.isPaused(now):
+		s.State = statePaused
+		resumesAt := cs.PauseEndsAt
+		s.ResumesAt = &resumesAt
+	}
+	return s
+}
+
+func (cfg *config) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	now := time.Now()
+	if !session.IsActive || session.IsTimeExceeded() {
+		respondWithJSON(w, http.StatusConflict, map[string]string{"error": "Session has already ended"})
+		return
+	}
+	if !session.pause(now, cfg.maxPause) {
+		respondWithJSON(w, http.StatusConflict, map[string]string{"error": "Pause time for this session is used up"})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, session.state(now))
+}
+
+func (cfg *config) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	now := time.Now()
+	session.resume(now)
+	session.LastActivityTime = now
+	respondWithJSON(w, http.StatusOK, session.state(now))
+}
+
+// sessionFromPath looks up the {sessionId} path value, writing the 404 itself when there is no such session.
+func sessionFromPath(w http.ResponseWriter, r *http.Request) (*ChatSession, bool) {
+	sessionID := r.PathValue("sessionId")
+	setRequestSessionID(r.Context(), sessionID)
+
+	session := lookupSession(sessionID)
+	if session == nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Session not found or has expired"})
+		return nil, false
+	}
+	return session, true
+}
+
+// there is one interviewer so far, the one getSystemInstructions describes
+const defaultPersona = "senior-developer"
+
+// who said a Message
+const (
+	roleInterviewer = "interviewer"
+	roleCandidate   = "candidate"
+)
+
+// Message is one line of the conversation as the user saw it. unlike ChatHistory it has no prompts,
+// summaries or time notes, and compacting the history leaves it alone.
+type Message struct {
+	Index int       `json:"index"`
+	Role  string    `json:"role"`
+	Text  string    `json:"text"`
+	Time  time.Time `json:"time"`
+}
+
+// addMessage appends to the visible conversation. callers hold mu, or own the session before it is shared.
+func (cs *ChatSession) addMessage(role, text string, at time.Time) {
+	cs.Messages = append(cs.Messages, Message{Index: len(cs.Messages), Role: role, Text: text, Time: at})
+}
+
+// turnCount is how many answers the user gave.
+func (cs *ChatSession) turnCount() int {
+	n := 0
+	for _, m := range cs.Messages {
+		if m.Role == roleCandidate {
+			n++
+		}
+	}
+	return n
+}
+
+// SessionInfo is GET /session/{id}, enough for the client to pick a session back up after a reload.
+type SessionInfo struct {
+	SessionState
+	ArticleURL       string        `json:"articleUrl"`
+	ArticleURLs      []string      `json:"articleUrls"`
+	Topic            string        `json:"topic,omitempty"`
+	Persona          string        `json:"persona"`
+	TimeLimitSeconds int           `json:"timeLimitSeconds"`
+	IsActive         bool          `json:"isActive"`
+	TurnCount        int           `json:"turnCount"`
+	MessageCount     int           `json:"messageCount"`
+	StartTime        time.Time     `json:"startTime"`
+	Voice            VoiceSettings `json:"voice"`
+	Usage            Usage         `json:"usage"`
+	ForkedFrom       string        `json:"forkedFrom,omitempty"`
+}
+
+// sessionHandler is GET /session/{id}: the session's settings, clock and usage, for a client picking
+// it back up after a reload. it reads under mu, so a turn being committed shows up whole or not at all.
+func (cfg *config) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	respondWithJSON(w, http.StatusOK, SessionInfo{
+		SessionState:     session.state(time.Now()),
+		ArticleURL:       session.ArticleURL,
+		ArticleURLs:      session.ArticleURLs,
+		Topic:            session.Topic,
+		Persona:          session.Persona,
+		TimeLimitSeconds: session.TimeLimitSeconds,
+		IsActive:         session.IsActive && !session.IsTimeExceeded(),
+		TurnCount:        session.turnCount(),
+		MessageCount:     len(session.Messages),
+		StartTime:        session.StartTime,
+		Voice:            session.Voice,
+		Usage:            sessionUsage(session),
+		ForkedFrom:       session.ForkedFrom,
+	})
+}
+
+const (
+	defaultMessagesPage = 50
+	maxMessagesPage     = 200
+)
+
+type MessagesPage struct {
+	Messages []Message `json:"messages"`
+	Total    int       `json:"total"`
+	// offset of the next page, missing on the last one
+	NextOffset *int `json:"nextOffset,omitempty"`
+}
+
+// messagesHandler pages through the conversation oldest first with ?offset= and ?limit=.
+func (cfg *config) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "'offset' must be a non-negative integer"})
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultMessagesPage)
+	if err != nil || limit <= 0 || limit > maxMessagesPage {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "'limit' must be between 1 and " + strconv.Itoa(maxMessagesPage)})
+		return
+	}
+
+	session, ok := sessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	total := len(session.Messages)
+	// clamped before adding, a huge offset would wrap around
+	start := min(offset, total)
+	end := start + min(limit, total-start)
+	page := MessagesPage{Messages: slices.Clone(session.Messages[start:end]), Total: total}
+
+	if page.Messages == nil {
+		page.Messages = []Message{}
+	}
+	if end < total {
+		page.NextOffset = &end
+	}
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(v)
+}
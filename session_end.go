@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// why a session ended
+const (
+	endUserEnded   = "user_ended"
+	endTimeExpired = "time_expired"
+	endIdle        = "idle"
+)
+
+// how often the reaper looks for sessions that ran out of time or were left alone
+const reapInterval = time.Minute
+
+// sessionEndHook runs once per session after it ended, off the request path. the session must not be changed.
+type sessionEndHook func(ctx context.Context, session *ChatSession)
+
+// post-session processing, evaluation and the like goes here
+var sessionEndHooks = []sessionEndHook{logSessionSummary}
+
+type EndSessionResponse struct {
+	SessionState
+	// the interviewer's closing words, empty when the model could not be reached or the daily quota is used up
+	Message string `json:"message"`
+}
+
+func (cfg *config) endSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	if !session.IsActive {
+		session.mu.Unlock()
+		respondWithJSON(w, http.StatusConflict, map[string]string{"error": "Session has already ended"})
+		return
+	}
+	if session.turnInFlight {
+		session.mu.Unlock()
+		respondWithJSON(w, http.StatusConflict, map[string]string{"error": "A turn is in progress, end the session once it is answered"})
+		return
+	}
+	// ending a session that ran out of time is not the user ending it
+	reason := endUserEnded
+	if session.TimeRemaining() <= 0 {
+		reason = endTimeExpired
+	}
+	// like a chat turn, the lock is not held while the model writes the closing words
+	history := session.ChatHistory
+	session.turnInFlight = true
+	session.mu.Unlock()
+
+	// the session ends either way, a failed wrap-up only costs the closing words.
+	// over the token quota it is not asked for at all
+	var turn *genai.Content
+	var message string
+	err := errQuotaExceeded
+	if cfg.quota.tokensExceeded(session.UserID) {
+		errorsTotal.WithLabelValues(causeQuotaExceeded).Inc()
+	} else {
+		turn, message, err = cfg.wrapUp(r.Context(), session, history, reason)
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "could not generate wrap-up message", "error", err)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.turnInFlight = false
+	if err == nil {
+		session.ChatHistory = append(session.ChatHistory, turn, &genai.Content{
+			Parts: []genai.Part{genai.Text(message)},
+			Role:  "model",
+		})
+		session.addMessage(roleInterviewer, message, time.Now())
+	}
+	now := time.Now()
+	session.end(reason, now)
+
+	respondWithJSON(w, http.StatusOK, EndSessionResponse{SessionState: session.state(now), Message: message})
+}
+
+// wrapUp asks the model for its closing words. adding them to the conversation is up to the caller.
+func (cfg *config) wrapUp(ctx context.Context, session *ChatSession, history []*genai.Content, reason string) (*genai.Content, string, error) {
+	why := "The candidate wants to end the interview now."
+	if reason == endTimeExpired {
+		why = "The time for the interview is up."
+	}
+	turn := &genai.Content{
+		Parts: []genai.Part{genai.Text(why + " Close it in a few sentences: what they did well, the one or two things worth working on, and well wishes. Do not ask any more questions.")},
+		Role:  "user",
+	}
+	reply, usage, err := cfg.generateResponse(ctx, history, turn)
+	if err != nil {
+		return nil, "", err
+	}
+	recordUsage(session.UserID, session, tokenUsage(usage))
+	return turn, reply, nil
+}
+
+// end marks the session inactive and starts the post-session hooks. callers hold mu.
+func (cs *ChatSession) end(reason string, now time.Time) {
+	// the clock stops where it is, an open pause is closed first so the remaining time stays put
+	cs.resume(now)
+	cs.IsActive = false
+	cs.EndReason = reason
+	cs.EndedAt = now
+	sessionsEnded.WithLabelValues(reason).Inc()
+
+	// hooks read the session, a copy keeps them off its lock
+	snapshot := cs.snapshot()
+	go func() {
+		ctx := context.Background()
+		for _, hook := range sessionEndHooks {
+			hook(ctx, snapshot)
+		}
+	}()
+}
+
+// snapshot is a copy of what the hooks may read. callers hold mu.
+func (cs *ChatSession) snapshot() *ChatSession {
+	return &ChatSession{
+		ID:               cs.ID,
+		UserID:           cs.UserID,
+		ChatHistory:      append([]*genai.Content(nil), cs.ChatHistory...),
+		Messages:         append([]Message(nil), cs.Messages...),
+		ArticleURL:       cs.ArticleURL,
+		ArticleURLs:      cs.ArticleURLs,
+		Topic:            cs.Topic,
+		Persona:          cs.Persona,
+		StartTime:        cs.StartTime,
+		TimeLimitSeconds: cs.TimeLimitSeconds,
+		PausedTotal:      cs.PausedTotal,
+		EndReason:        cs.EndReason,
+		EndedAt:          cs.EndedAt,
+		Usage:            sessionUsage(cs),
+		Speaking:         speakingReport(cs).Turns,
+	}
+}
+
+func logSessionSummary(ctx context.Context, session *ChatSession) {
+	report := speakingReport(session)
+	slog.InfoContext(ctx, "session ended",
+		"sessionId", session.ID,
+		"userId", session.UserID,
+		"reason", session.EndReason,
+		"durationSeconds", int(session.EndedAt.Sub(session.StartTime).Seconds()),
+		"pausedSeconds", int(session.PausedTotal.Seconds()),
+		"answers", session.turnCount(),
+		"totalTokens", session.Usage.TotalTokens,
+		"wordsPerMinute", report.WordsPerMinute,
+	)
+}
+
+// reapSessions ends sessions whose time is up or that nobody touched for idleTimeout, and drops
+// sessions that ended more than retention ago, until ctx is done.
+func (cfg *config) reapSessions(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cfg.reapOnce(now)
+		}
+	}
+}
+
+func (cfg *config) reapOnce(now time.Time) {
+	sessionsMutex.RLock()
+	sessions := make([]*ChatSession, 0, len(chatSessions))
+	for _, s := range chatSessions {
+		sessions = append(sessions, s)
+	}
+	sessionsMutex.RUnlock()
+
+	var evict []string
+	for _, s := range sessions {
+		s.mu.Lock()
+		// a session with a turn in flight is not idle, and its answer should still land
+		if reason := s.expiry(now, cfg.idleTimeout); reason != "" && !s.turnInFlight {
+			s.end(reason, now)
+		}
+		// ended sessions stay around a while for the summary page and forks, then they go
+		if !s.IsActive && now.Sub(s.EndedAt) > cfg.sessionRetention {
+			evict = append(evict, s.ID)
+		}
+		s.mu.Unlock()
+	}
+
+	if len(evict) == 0 {
+		return
+	}
+	sessionsMutex.Lock()
+	for _, id := range evict {
+		delete(chatSessions, id)
+	}
+	sessionsMutex.Unlock()
+	slog.Info("evicted ended sessions", "count", len(evict))
+}
+
+// expiry is why an active session should be ended now, or "" if it shouldnt. callers hold mu.
+func (cs *ChatSession) expiry(now time.Time, idleTimeout time.Duration) string {
+	if !cs.IsActive {
+		return ""
+	}
+	if cs.elapsed(now) > time.Duration(cs.TimeLimitSeconds)*time.Second {
+		return endTimeExpired
+	}
+	if cs.isPaused(now) || idleTimeout <= 0 {
+		return ""
+	}
+	// a pause that ran out counts as activity when it ended
+	lastSeen := cs.LastActivityTime
+	if cs.PauseEndsAt.After(lastSeen) {
+		lastSeen = cs.PauseEndsAt
+	}
+	if now.Sub(lastSeen) > idleTimeout {
+		return endIdle
+	}
+	return ""
+}
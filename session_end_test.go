@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+func TestReapOnce(t *testing.T) {
+	cfg := &config{idleTimeout: 30 * time.Minute, sessionRetention: time.Hour}
+	now := time.Now()
+
+	active := addTestSession(t, &ChatSession{ID: "reap-active", StartTime: now.Add(-time.Minute), LastActivityTime: now, TimeLimitSeconds: 600, IsActive: true})
+	outOfTime := addTestSession(t, &ChatSession{ID: "reap-time", StartTime: now.Add(-11 * time.Minute), LastActivityTime: now, TimeLimitSeconds: 600, IsActive: true})
+	idle := addTestSession(t, &ChatSession{ID: "reap-idle", StartTime: now.Add(-40 * time.Minute), LastActivityTime: now.Add(-31 * time.Minute), TimeLimitSeconds: 3600, IsActive: true})
+	inFlight := addTestSession(t, &ChatSession{ID: "reap-inflight", StartTime: now.Add(-11 * time.Minute), LastActivityTime: now, TimeLimitSeconds: 600, IsActive: true, turnInFlight: true})
+	endedRecently := addTestSession(t, &ChatSession{ID: "reap-recent", StartTime: now.Add(-time.Hour), EndedAt: now.Add(-10 * time.Minute), EndReason: endUserEnded})
+	endedLongAgo := addTestSession(t, &ChatSession{ID: "reap-old", StartTime: now.Add(-3 * time.Hour), EndedAt: now.Add(-2 * time.Hour), EndReason: endUserEnded})
+
+	cfg.reapOnce(now)
+
+	tests := []struct {
+		session    *ChatSession
+		wantActive bool
+		wantReason string
+		wantKept   bool
+	}{
+		{session: active, wantActive: true, wantKept: true},
+		{session: outOfTime, wantReason: endTimeExpired, wantKept: true},
+		{session: idle, wantReason: endIdle, wantKept: true},
+		{session: inFlight, wantActive: true, wantKept: true},
+		{session: endedRecently, wantReason: endUserEnded, wantKept: true},
+		{session: endedLongAgo, wantReason: endUserEnded, wantKept: false},
+	}
+	for _, tt := range tests {
+		s := tt.session
+		if s.IsActive != tt.wantActive || s.EndReason != tt.wantReason {
+			t.Errorf("%s: active = %v, reason = %q, want %v, %q", s.ID, s.IsActive, s.EndReason, tt.wantActive, tt.wantReason)
+		}
+		if kept := lookupSession(s.ID) != nil; kept != tt.wantKept {
+			t.Errorf("%s: kept = %v, want %v", s.ID, kept, tt.wantKept)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		session *ChatSession
+		want    string
+	}{
+		{name: "time left", session: &ChatSession{StartTime: now.Add(-time.Minute), LastActivityTime: now, TimeLimitSeconds: 600, IsActive: true}},
+		{name: "out of time", session: &ChatSession{StartTime: now.Add(-11 * time.Minute), LastActivityTime: now, TimeLimitSeconds: 600, IsActive: true}, want: endTimeExpired},
+		{name: "paused time does not count", session: &ChatSession{StartTime: now.Add(-11 * time.Minute), LastActivityTime: now, TimeLimitSeconds: 600, IsActive: true, PausedTotal: 5 * time.Minute}},
+		{name: "idle", session: &ChatSession{StartTime: now.Add(-time.Hour), LastActivityTime: now.Add(-31 * time.Minute), TimeLimitSeconds: 7200, IsActive: true}, want: endIdle},
+		{name: "paused is not idle", session: &ChatSession{StartTime: now.Add(-time.Hour), LastActivityTime: now.Add(-31 * time.Minute), TimeLimitSeconds: 7200, IsActive: true, PausedAt: now.Add(-time.Minute), PauseEndsAt: now.Add(time.Minute)}},
+		{name: "already ended", session: &ChatSession{StartTime: now.Add(-time.Hour), TimeLimitSeconds: 60}},
+	}
+	for _, tt := range tests {
+		if got := tt.session.expiry(now, 30*time.Minute); got != tt.want {
+			t.Errorf("%s: expiry = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEndSessionHandler(t *testing.T) {
+	clearUsage(t, "end-user")
+	recordUsage("end-user", nil, Usage{TotalTokens: 100})
+
+	tests := []struct {
+		name        string
+		quota       int64
+		startedAgo  time.Duration
+		wantMessage string
+		wantCalls   int
+		wantReason  string
+		wantPrompt  string
+	}{
+		{name: "wrap-up", quota: 1000, wantMessage: "well done", wantCalls: 1, wantReason: endUserEnded, wantPrompt: "The candidate wants to end the interview now."},
+		{name: "out of time", quota: 1000, startedAgo: time.Hour, wantMessage: "well done", wantCalls: 1, wantReason: endTimeExpired, wantPrompt: "The time for the interview is up."},
+		// the session still ends, just without closing words
+		{name: "over the token quota", quota: 100, wantCalls: 0, wantReason: endUserEnded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := &fakeModel{replies: []fakeReply{{text: "well done"}}}
+			cfg := fakeModelConfig(model)
+			cfg.quota.dailyTokens = tt.quota
+			session := addTestSession(t, &ChatSession{
+				ID:               "end-test",
+				UserID:           "end-user",
+				StartTime:        time.Now().Add(-tt.startedAgo),
+				TimeLimitSeconds: 600,
+				IsActive:         true,
+				ChatHistory:      []*genai.Content{{Parts: []genai.Part{genai.Text("prompt")}, Role: "user"}},
+			})
+
+			w := httptest.NewRecorder()
+			cfg.endSessionHandler(w, sessionRequest(http.MethodPost, "/session/end-test/end", session.ID))
+			if w.Code != http.StatusOK {
+				t.Fatalf("code = %d: %s", w.Code, w.Body)
+			}
+			var resp EndSessionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", resp.Message, tt.wantMessage)
+			}
+			if model.callCount() != tt.wantCalls {
+				t.Errorf("made %d model calls, want %d", model.callCount(), tt.wantCalls)
+			}
+			if session.IsActive || session.EndReason != tt.wantReason {
+				t.Errorf("active = %v, reason = %q, want ended as %s", session.IsActive, session.EndReason, tt.wantReason)
+			}
+			if tt.wantCalls > 0 {
+				if prompt := string(model.calls[0].turn.Parts[0].(genai.Text)); !strings.HasPrefix(prompt, tt.wantPrompt) {
+					t.Errorf("wrap-up prompt = %q, want it to start with %q", prompt, tt.wantPrompt)
+				}
+			}
+		})
+	}
+}
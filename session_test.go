@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// addTestSession registers s in chatSessions for the length of the test.
+func addTestSession(t *testing.T, s *ChatSession) *ChatSession {
+	t.Helper()
+	if s.TurnResponses == nil {
+		s.TurnResponses = make(map[string]turnResponse)
+	}
+	sessionsMutex.Lock()
+	chatSessions[s.ID] = s
+	sessionsMutex.Unlock()
+	t.Cleanup(func() {
+		sessionsMutex.Lock()
+		delete(chatSessions, s.ID)
+		sessionsMutex.Unlock()
+	})
+	return s
+}
+
+// sessionRequest builds a request with the {sessionId} path value set, like the mux does.
+func sessionRequest(method, target, sessionID string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.SetPathValue("sessionId", sessionID)
+	return r
+}
+
+func TestMessagesHandler(t *testing.T) {
+	cfg := &config{}
+	session := addTestSession(t, &ChatSession{ID: "messages-test", StartTime: time.Now(), IsActive: true})
+	for i := range 5 {
+		session.addMessage(roleCandidate, "answer "+strconv.Itoa(i), time.Now())
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantFirst int
+		wantCount int
+		wantNext  int // -1 for none
+	}{
+		{name: "defaults", query: "", wantCode: http.StatusOK, wantFirst: 0, wantCount: 5, wantNext: -1},
+		{name: "first page", query: "?limit=2", wantCode: http.StatusOK, wantFirst: 0, wantCount: 2, wantNext: 2},
+		{name: "middle page", query: "?offset=2&limit=2", wantCode: http.StatusOK, wantFirst: 2, wantCount: 2, wantNext: 4},
+		{name: "last page", query: "?offset=4&limit=2", wantCode: http.StatusOK, wantFirst: 4, wantCount: 1, wantNext: -1},
+		{name: "offset past the end", query: "?offset=50", wantCode: http.StatusOK, wantCount: 0, wantNext: -1},
+		{name: "overflowing offset", query: "?offset=9223372036854775807", wantCode: http.StatusOK, wantCount: 0, wantNext: -1},
+		{name: "overflowing offset and limit", query: "?offset=9223372036854775807&limit=200", wantCode: http.StatusOK, wantCount: 0, wantNext: -1},
+		{name: "negative offset", query: "?offset=-1", wantCode: http.StatusBadRequest},
+		{name: "offset not a number", query: "?offset=abc", wantCode: http.StatusBadRequest},
+		{name: "zero limit", query: "?limit=0", wantCode: http.StatusBadRequest},
+		{name: "limit too big", query: "?limit=201", wantCode: http.StatusBadRequest},
+		{name: "limit overflowing int", query: "?limit=99999999999999999999", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.messagesHandler(w, sessionRequest(http.MethodGet, "/session/messages-test/messages"+tt.query, session.ID))
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var page MessagesPage
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != 5 || len(page.Messages) != tt.wantCount {
+				t.Fatalf("got %d of %d messages, want %d of 5", len(page.Messages), page.Total, tt.wantCount)
+			}
+			if tt.wantCount > 0 && page.Messages[0].Index != tt.wantFirst {
+				t.Errorf("first index = %d, want %d", page.Messages[0].Index, tt.wantFirst)
+			}
+			switch {
+			case tt.wantNext < 0 && page.NextOffset != nil:
+				t.Errorf("nextOffset = %d, want none", *page.NextOffset)
+			case tt.wantNext >= 0 && (page.NextOffset == nil || *page.NextOffset != tt.wantNext):
+				t.Errorf("nextOffset = %v, want %d", page.NextOffset, tt.wantNext)
+			}
+		})
+	}
+
+	// the lock must be free again whatever was asked for
+	if !session.mu.TryLock() {
+		t.Fatal("session lock still held after the requests")
+	}
+	session.mu.Unlock()
+}
+
+func TestMessagesHandlerUnknownSession(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&config{}).messagesHandler(w, sessionRequest(http.MethodGet, "/session/nope/messages", "nope"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("code = %d, want 404", w.Code)
+	}
+}
+
+func TestPauseBudget(t *testing.T) {
+	cfg := &config{maxPause: 10 * time.Minute}
+	tests := []struct {
+		name        string
+		pausedTotal time.Duration
+		wantCode    int
+		wantResumes time.Duration
+	}{
+		{name: "first pause gets the whole budget", wantCode: http.StatusOK, wantResumes: 10 * time.Minute},
+		{name: "later pause gets what is left", pausedTotal: 8 * time.Minute, wantCode: http.StatusOK, wantResumes: 2 * time.Minute},
+		{name: "budget used up", pausedTotal: 10 * time.Minute, wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := addTestSession(t, &ChatSession{
+				ID:               "pause-test",
+				StartTime:        time.Now().Add(-time.Minute),
+				TimeLimitSeconds: 3600,
+				IsActive:         true,
+				PausedTotal:      tt.pausedTotal,
+			})
+			w := httptest.NewRecorder()
+			cfg.pauseHandler(w, sessionRequest(http.MethodPost, "/session/pause-test/pause", session.ID))
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var state SessionState
+			if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+				t.Fatal(err)
+			}
+			if state.State != statePaused || state.ResumesAt == nil {
+				t.Fatalf("state = %+v, want paused", state)
+			}
+			if got := time.Until(*state.ResumesAt); got > tt.wantResumes || got < tt.wantResumes-5*time.Second {
+				t.Errorf("resumes in %v, want about %v", got, tt.wantResumes)
+			}
+		})
+	}
+}
+
+// pausing and resuming over and over must not hold the clock for longer than maxPause in total
+func TestRepeatedPausesShareTheBudget(t *testing.T) {
+	const maxPause = 20 * time.Minute
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	session := &ChatSession{StartTime: now, TimeLimitSeconds: 3600, IsActive: true}
+
+	pauses := 0
+	for session.pause(now, maxPause) {
+		pauses++
+		if pauses > 10 {
+			t.Fatal("pausing never ran out")
+		}
+		now = now.Add(5 * time.Minute)
+		session.resume(now)
+		now = now.Add(time.Minute)
+	}
+	if pauses != 4 {
+		t.Errorf("paused %d times, want 4 pauses of 5 minutes", pauses)
+	}
+	if session.PausedTotal != maxPause {
+		t.Errorf("paused %v in total, want the %v allowed", session.PausedTotal, maxPause)
+	}
+}
+
+func TestPause(t *testing.T) {
+	const maxPause = 10 * time.Minute
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	session := &ChatSession{StartTime: start, TimeLimitSeconds: 3600, IsActive: true}
+	if !session.pause(start, maxPause) || !session.PauseEndsAt.Equal(start.Add(maxPause)) {
+		t.Fatalf("first pause ends at %v, want after the whole budget", session.PauseEndsAt)
+	}
+	// pausing again while paused keeps the pause that is running
+	if !session.pause(start.Add(time.Minute), maxPause) || !session.PausedAt.Equal(start) {
+		t.Errorf("second pause restarted the first, paused at %v", session.PausedAt)
+	}
+
+	// a pause that ran out on its own uses up the budget
+	later := start.Add(time.Hour)
+	if session.pause(later, maxPause) {
+		t.Error("paused again with nothing left")
+	}
+	if session.PausedTotal != maxPause || !session.PausedAt.IsZero() {
+		t.Errorf("paused total = %v, paused at = %v, want the budget used up and no pause", session.PausedTotal, session.PausedAt)
+	}
+}
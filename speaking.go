@@ -0,0 +1,232 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// gaps between words longer than this count as a long pause
+const longPauseSeconds = 2.0
+
+// what people say while thinking. google and whisper both drop some "um"s on their own, so these are lower bounds.
+var fillerWords = map[string]bool{
+	"um": true, "umm": true, "uh": true, "uhh": true, "er": true, "erm": true, "ah": true, "hmm": true,
+	"like": true, "basically": true, "actually": true, "literally": true, "obviously": true,
+}
+
+// "kind of" and "sort of" are left out, "a kind of queue" is too common in these answers to tell apart
+var fillerPhrases = [][]string{{"you", "know"}, {"i", "mean"}}
+
+// the phrases after these are the real words, "do you know", "what i mean is"
+var phraseNotFiller = map[string]bool{
+	"do": true, "did": true, "does": true, "dont": true, "if": true, "what": true, "would": true, "should": true,
+}
+
+// "like" after these is the real word, "looks like a queue"
+var likeNotFiller = map[string]bool{
+	"would": true, "look": true, "looks": true, "looked": true, "seem": true, "seems": true,
+	"feel": true, "feels": true, "something": true, "things": true, "just": true, "is": true,
+}
+
+// SpeakingTurn is how one answer was delivered, over however many recordings it took.
+type SpeakingTurn struct {
+	// 1 for the first answer of the session
+	Answer              int            `json:"answer"`
+	Words               int            `json:"words"`
+	DurationSeconds     float64        `json:"durationSeconds"`
+	WordsPerMinute      float64        `json:"wordsPerMinute"`
+	Fillers             map[string]int `json:"fillers"`
+	FillerCount         int            `json:"fillerCount"`
+	LongPauses          int            `json:"longPauses"`
+	LongestPauseSeconds float64        `json:"longestPauseSeconds"`
+}
+
+// SpeakingReport is GET /session/{id}/speaking-report, the turns summed up.
+type SpeakingReport struct {
+	SessionID            string         `json:"sessionId"`
+	Answers              int            `json:"answers"`
+	TotalWords           int            `json:"totalWords"`
+	SpeakingSeconds      float64        `json:"speakingSeconds"`
+	WordsPerMinute       float64        `json:"wordsPerMinute"`
+	Fillers              map[string]int `json:"fillers"`
+	FillersPer100Words   float64        `json:"fillersPer100Words"`
+	LongPauses           int            `json:"longPauses"`
+	LongestPauseSeconds  float64        `json:"longestPauseSeconds"`
+	AverageAnswerSeconds float64        `json:"averageAnswerSeconds"`
+	AverageAnswerWords   float64        `json:"averageAnswerWords"`
+	Turns                []SpeakingTurn `json:"turns"`
+}
+
+// guards session.Speaking. not the session's mu, /stt works without a session lookup holding it.
+var speakingMutex sync.Mutex
+
+// analyzeSpeaking measures one transcript. the timings come from the recognizer's word offsets,
+// without them only the word and filler counts are filled in.
+func analyzeSpeaking(t *Transcript) SpeakingTurn {
+	turn := SpeakingTurn{Fillers: map[string]int{}}
+
+	var words []string
+	if len(t.Words) > 0 {
+		for _, w := range t.Words {
+			words = append(words, normalizeWord(w.Word))
+		}
+		first, last := t.Words[0], t.Words[len(t.Words)-1]
+		turn.DurationSeconds = last.EndSeconds - first.StartSeconds
+		for i := 1; i < len(t.Words); i++ {
+			gap := t.Words[i].StartSeconds - t.Words[i-1].EndSeconds
+			if gap >= longPauseSeconds {
+				turn.LongPauses++
+			}
+			turn.LongestPauseSeconds = max(turn.LongestPauseSeconds, gap)
+		}
+	} else {
+		for _, w := range strings.Fields(t.Text) {
+			words = append(words, normalizeWord(w))
+		}
+		if len(t.Segments) > 0 {
+			turn.DurationSeconds = t.Segments[len(t.Segments)-1].EndSeconds
+		}
+	}
+
+	turn.Words = len(words)
+	if turn.DurationSeconds > 0 {
+		turn.WordsPerMinute = roundTo(float64(turn.Words)/turn.DurationSeconds*60, 1)
+	}
+	turn.DurationSeconds = roundTo(turn.DurationSeconds, 2)
+	turn.LongestPauseSeconds = roundTo(turn.LongestPauseSeconds, 2)
+
+	for i := 0; i < len(words); i++ {
+		if phrase := fillerPhraseAt(words, i); phrase != "" {
+			turn.Fillers[phrase]++
+			i++
+			continue
+		}
+		w := words[i]
+		if !fillerWords[w] || (w == "like" && i > 0 && likeNotFiller[words[i-1]]) {
+			continue
+		}
+		turn.Fillers[w]++
+	}
+	for _, n := range turn.Fillers {
+		turn.FillerCount += n
+	}
+	return turn
+}
+
+func fillerPhraseAt(words []string, i int) string {
+	if i > 0 && phraseNotFiller[words[i-1]] {
+		return ""
+	}
+	for _, p := range fillerPhrases {
+		if i+1 < len(words) && words[i] == p[0] && words[i+1] == p[1] {
+			return p[0] + " " + p[1]
+		}
+	}
+	return ""
+}
+
+func normalizeWord(w string) string {
+	return strings.ToLower(strings.TrimFunc(w, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }))
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+// recordSpeaking adds a recording to the session's analytics, a nil session is fine. recordings
+// before the answer is sent to /chat all belong to that answer, so stopping and starting the mic
+// does not make one answer count as several.
+func recordSpeaking(session *ChatSession, t *Transcript) {
+	if session == nil || t == nil {
+		return
+	}
+	turn := analyzeSpeaking(t)
+
+	session.mu.Lock()
+	turn.Answer = session.turnCount() + 1
+	session.mu.Unlock()
+
+	speakingMutex.Lock()
+	defer speakingMutex.Unlock()
+	if n := len(session.Speaking); n > 0 && session.Speaking[n-1].Answer == turn.Answer {
+		session.Speaking[n-1].add(turn)
+		return
+	}
+	session.Speaking = append(session.Speaking, turn)
+}
+
+// add folds another recording of the same answer into t.
+func (t *SpeakingTurn) add(o SpeakingTurn) {
+	t.Words += o.Words
+	t.DurationSeconds = roundTo(t.DurationSeconds+o.DurationSeconds, 2)
+	t.WordsPerMinute = 0
+	if t.DurationSeconds > 0 {
+		t.WordsPerMinute = roundTo(float64(t.Words)/t.DurationSeconds*60, 1)
+	}
+	for w, n := range o.Fillers {
+		t.Fillers[w] += n
+	}
+	t.FillerCount += o.FillerCount
+	t.LongPauses += o.LongPauses
+	t.LongestPauseSeconds = max(t.LongestPauseSeconds, o.LongestPauseSeconds)
+}
+
+// speakingUpTo copies the turns for the first n answers, for a rewind or a fork.
+func speakingUpTo(turns []SpeakingTurn, n int) []SpeakingTurn {
+	var kept []SpeakingTurn
+	for _, t := range turns {
+		if t.Answer <= n {
+			t.Fillers = maps.Clone(t.Fillers)
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+func speakingReport(session *ChatSession) SpeakingReport {
+	speakingMutex.Lock()
+	turns := make([]SpeakingTurn, len(session.Speaking))
+	for i, t := range session.Speaking {
+		t.Fillers = maps.Clone(t.Fillers)
+		turns[i] = t
+	}
+	speakingMutex.Unlock()
+
+	report := SpeakingReport{SessionID: session.ID, Answers: len(turns), Fillers: map[string]int{}, Turns: turns}
+	var fillers int
+	for _, t := range turns {
+		report.TotalWords += t.Words
+		report.SpeakingSeconds += t.DurationSeconds
+		report.LongPauses += t.LongPauses
+		report.LongestPauseSeconds = max(report.LongestPauseSeconds, t.LongestPauseSeconds)
+		for w, n := range t.Fillers {
+			report.Fillers[w] += n
+		}
+		fillers += t.FillerCount
+	}
+	if report.SpeakingSeconds > 0 {
+		report.WordsPerMinute = roundTo(float64(report.TotalWords)/report.SpeakingSeconds*60, 1)
+	}
+	if report.TotalWords > 0 {
+		report.FillersPer100Words = roundTo(float64(fillers)/float64(report.TotalWords)*100, 1)
+	}
+	if report.Answers > 0 {
+		report.AverageAnswerSeconds = roundTo(report.SpeakingSeconds/float64(report.Answers), 2)
+		report.AverageAnswerWords = roundTo(float64(report.TotalWords)/float64(report.Answers), 1)
+	}
+	report.SpeakingSeconds = roundTo(report.SpeakingSeconds, 2)
+	return report
+}
+
+func (cfg *config) speakingReportHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, speakingReport(session))
+}
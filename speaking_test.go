@@ -0,0 +1,79 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeSpeakingFillers(t *testing.T) {
+	tests := []struct {
+		text string
+		want map[string]int
+	}{
+		{"um so we shard, uh, by user", map[string]int{"um": 1, "uh": 1}},
+		{"it looks like a queue, like, basically", map[string]int{"like": 1, "basically": 1}},
+		{"it looks like a queue", map[string]int{}},
+		{"you know, the cache sits in front", map[string]int{"you know": 1}},
+		{"do you know how many reads there are", map[string]int{}},
+		{"I mean the writes are rare", map[string]int{"i mean": 1}},
+		{"what I mean is the writes are rare", map[string]int{}},
+		// too often a real part of the answer to count
+		{"it's a kind of queue, sort of a log", map[string]int{}},
+	}
+	for _, tt := range tests {
+		turn := analyzeSpeaking(&Transcript{Text: tt.text})
+		if !maps.Equal(turn.Fillers, tt.want) {
+			t.Errorf("%q: fillers = %v, want %v", tt.text, turn.Fillers, tt.want)
+		}
+	}
+}
+
+func TestAnalyzeSpeakingTimings(t *testing.T) {
+	turn := analyzeSpeaking(&Transcript{Words: []WordTiming{
+		{Word: "um", StartSeconds: 0, EndSeconds: 0.5},
+		{Word: "shard", StartSeconds: 3, EndSeconds: 3.5},
+		{Word: "by", StartSeconds: 3.6, EndSeconds: 4},
+		{Word: "user", StartSeconds: 4, EndSeconds: 6},
+	}})
+	if turn.Words != 4 || turn.DurationSeconds != 6 || turn.WordsPerMinute != 40 {
+		t.Errorf("words, duration, wpm = %d, %v, %v, want 4, 6, 40", turn.Words, turn.DurationSeconds, turn.WordsPerMinute)
+	}
+	if turn.LongPauses != 1 || turn.LongestPauseSeconds != 2.5 {
+		t.Errorf("long pauses = %d, longest = %v, want 1 and 2.5", turn.LongPauses, turn.LongestPauseSeconds)
+	}
+}
+
+func TestRecordSpeakingGroupsRecordingsByAnswer(t *testing.T) {
+	session := &ChatSession{}
+	session.addMessage(roleInterviewer, "design a url shortener", time.Now())
+	words := func(text string, seconds float64) *Transcript {
+		return &Transcript{Text: text, Segments: []TranscriptSegment{{Text: text, EndSeconds: seconds}}}
+	}
+
+	// the mic stopped and started twice during the first answer
+	recordSpeaking(session, words("um hash the url", 2))
+	recordSpeaking(session, words("uh then store it", 4))
+	session.addMessage(roleCandidate, "um hash the url uh then store it", time.Now())
+	session.addMessage(roleInterviewer, "what about collisions?", time.Now())
+	recordSpeaking(session, words("retry with a salt", 3))
+
+	if len(session.Speaking) != 2 {
+		t.Fatalf("got %d speaking turns, want one per answer: %+v", len(session.Speaking), session.Speaking)
+	}
+	first := session.Speaking[0]
+	if first.Answer != 1 || first.Words != 8 || first.DurationSeconds != 6 || first.WordsPerMinute != 80 {
+		t.Errorf("first answer = %+v, want 8 words over 6s", first)
+	}
+	if first.FillerCount != 2 || first.Fillers["um"] != 1 || first.Fillers["uh"] != 1 {
+		t.Errorf("first answer fillers = %v", first.Fillers)
+	}
+	if second := session.Speaking[1]; second.Answer != 2 || second.Words != 4 {
+		t.Errorf("second answer = %+v", second)
+	}
+
+	report := speakingReport(session)
+	if report.Answers != 2 || report.TotalWords != 12 || report.AverageAnswerWords != 6 {
+		t.Errorf("report = %d answers, %d words, %v per answer, want 2, 12, 6", report.Answers, report.TotalWords, report.AverageAnswerWords)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whisperSpeechToText sends uploads to a whisper.cpp server (examples/server), for running without google.
+type whisperSpeechToText struct {
+	// the server's inference endpoint, e.g. http://127.0.0.1:8081/inference
+	url           string
+	ffmpegPath    string
+	lowConfidence float32
+	client        *http.Client
+}
+
+// whisperResponse is the verbose_json response of the whisper.cpp server.
+type whisperResponse struct {
+	Text     string `json:"text"`
+	Segments []struct {
+		Text       string  `json:"text"`
+		End        float64 `json:"end"`
+		AvgLogprob float64 `json:"avg_logprob"`
+		Words      []struct {
+			Word        string  `json:"word"`
+			Start       float64 `json:"start"`
+			End         float64 `json:"end"`
+			Probability float32 `json:"probability"`
+		} `json:"words"`
+	} `json:"segments"`
+}
+
+// whisper does its own decoding and reads these without help, the rest goes through ffmpeg when we have it
+var whisperFormats = map[string]bool{"wav": true, "flac": true, "mp3": true}
+
+func (ws *whisperSpeechToText) Transcribe(ctx context.Context, audio *audioInput, sessionTerms []string, progress func(sttProgress)) (*Transcript, time.Duration, error) {
+	data, filename := audio.data, "audio."+audio.format
+	switch {
+	case audio.format == "pcm":
+		data, filename = wavFromPCM(audio), "audio.wav"
+	case !whisperFormats[audio.format] && ws.ffmpegPath != "":
+		flac, err := transcodeToFlac(ctx, ws.ffmpegPath, audio.data)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to transcode audio for whisper", "error", err)
+			return nil, 0, fmt.Errorf("failed to transcode audio")
+		}
+		data, filename = flac, "audio.flac"
+	}
+	// otherwise whisper-server has to be running with --convert
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	part.Write(data)
+	mw.WriteField("response_format", "verbose_json")
+	mw.WriteField("temperature", "0")
+	mw.WriteField("prompt", whisperPrompt(sessionTerms))
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.url, &body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to reach whisper server", "error", err)
+		return nil, 0, fmt.Errorf("failed to recognize speech")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		slog.ErrorContext(ctx, "whisper server failed", "status", resp.StatusCode, "body", string(msg))
+		return nil, 0, fmt.Errorf("failed to recognize speech")
+	}
+
+	var wr whisperResponse
+	if err := json.NewDecoder(resp.Body).Decode(&wr); err != nil {
+		slog.ErrorContext(ctx, "failed to decode whisper response", "error", err)
+		return nil, 0, fmt.Errorf("failed to recognize speech")
+	}
+
+	transcript := ws.buildTranscript(&wr)
+	if transcript == nil {
+		return nil, 0, fmt.Errorf("no transcript found")
+	}
+	// the whole file is transcribed in one go, there is nothing to report in between
+	if progress != nil {
+		done := 1.0
+		progress(sttProgress{Progress: &done, Text: transcript.Text})
+	}
+	// nothing is billed when it runs on our own machine
+	return transcript, 0, nil
+}
+
+// buildTranscript gives whisper's output the same shape as google's.
+func (ws *whisperSpeechToText) buildTranscript(wr *whisperResponse) *Transcript {
+	segments := make([]recognizedSegment, 0, len(wr.Segments))
+	for _, seg := range wr.Segments {
+		// whisper has no segment confidence, the mean word probability is the closest thing
+		rs := recognizedSegment{text: seg.Text, confidence: float32(math.Exp(seg.AvgLogprob)), endSeconds: seg.End}
+		var sum float32
+		for _, w := range seg.Words {
+			rs.words = append(rs.words, WordTiming{Word: strings.TrimSpace(w.Word), StartSeconds: w.Start, EndSeconds: w.End, Confidence: w.Probability})
+			sum += w.Probability
+		}
+		if len(seg.Words) > 0 {
+			rs.confidence = sum / float32(len(seg.Words))
+		}
+		segments = append(segments, rs)
+	}
+	return assembleTranscript(segments, ws.lowConfidence)
+}
+
+// whisper only reads the last 224 tokens of the prompt. at about 4 characters a token this leaves some room
+const whisperPromptChars = 800
+
+// whisperPrompt lists the terms to spell right. whisper has no phrase boosting, but terms in the prompt
+// come out spelled the same way in the transcript. the session's terms go last so they are never the ones
+// cut off, the glossary fills what room is left.
+func whisperPrompt(sessionTerms []string) string {
+	const prefix = "A system design interview answer mentioning "
+	budget := whisperPromptChars - len(prefix) - len(".")
+	take := func(terms []string) []string {
+		var kept []string
+		for _, t := range terms {
+			if len(t)+len(", ") > budget {
+				break
+			}
+			kept = append(kept, t)
+			budget -= len(t) + len(", ")
+		}
+		return kept
+	}
+	session := take(sessionTerms)
+	terms := append(take(systemDesignGlossary), session...)
+	return prefix + strings.Join(terms, ", ") + "."
+}
+
+// wavFromPCM puts a header on raw 16 bit pcm so whisper knows the rate and channels.
+func wavFromPCM(audio *audioInput) []byte {
+	rate, channels := uint32(audio.sampleRate), uint16(audio.channels)
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+len(audio.data)))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, uint16(1))
+	binary.Write(&b, binary.LittleEndian, channels)
+	binary.Write(&b, binary.LittleEndian, rate)
+	binary.Write(&b, binary.LittleEndian, rate*uint32(channels)*2)
+	binary.Write(&b, binary.LittleEndian, channels*2)
+	binary.Write(&b, binary.LittleEndian, uint16(16))
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(audio.data)))
+	b.Write(audio.data)
+	return b.Bytes()
+}
+
+// localTextToSpeech runs a tts program that reads text on stdin and writes a wav to stdout, like piper or espeak-ng.
+type localTextToSpeech struct {
+	command func(ctx context.Context, voice VoiceSettings) *exec.Cmd
+	// without ffmpeg only wav can be served
+	ffmpegPath string
+}
+
+func (l *localTextToSpeech) Synthesize(ctx context.Context, text string, voice VoiceSettings, encoding ttsEncoding) ([]byte, error) {
+	cmd := l.command(ctx, voice)
+	cmd.Stdin = strings.NewReader(speechText(text))
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		slog.ErrorContext(ctx, "failed to synthesize speech", "command", cmd.Path, "error", err, "stderr", strings.TrimSpace(stderr.String()))
+		return nil, fmt.Errorf("failed to synthesize speech")
+	}
+
+	if encoding.contentType == "audio/wav" {
+		return out.Bytes(), nil
+	}
+	audio, err := transcodeSpeech(ctx, l.ffmpegPath, out.Bytes(), encoding)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to transcode speech", "encoding", encoding.contentType, "error", err)
+		return nil, fmt.Errorf("failed to synthesize speech")
+	}
+	return audio, nil
+}
+
+func (l *localTextToSpeech) Encodings() []ttsEncoding {
+	if l.ffmpegPath == "" {
+		return []ttsEncoding{ttsEncodings[2]}
+	}
+	return ttsEncodings
+}
+
+// speechText is the reply cleaned up for engines that take plain text, one paragraph or list item per line.
+func speechText(text string) string {
+	var lines []string
+	for _, block := range speechBlocks(text) {
+		lines = append(lines, strings.Join(block.sentences, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var ffmpegOutputs = map[string][]string{
+	"audio/mpeg": {"-f", "mp3"},
+	"audio/ogg":  {"-c:a", "libopus", "-f", "ogg"},
+}
+
+// transcodeSpeech turns a wav from a local engine into the format the client asked for.
+func transcodeSpeech(ctx context.Context, ffmpegPath string, wav []byte, encoding ttsEncoding) ([]byte, error) {
+	output, ok := ffmpegOutputs[encoding.contentType]
+	if !ok {
+		return nil, fmt.Errorf("no ffmpeg output for %s", encoding.contentType)
+	}
+	args := append([]string{"-hide_banner", "-loglevel", "error", "-f", "wav", "-i", "pipe:0"}, output...)
+	cmd := exec.CommandContext(ctx, ffmpegPath, append(args, "pipe:1")...)
+	cmd.Stdin = bytes.NewReader(wav)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// piper has no pitch, and takes the speed as how long each phoneme lasts
+func piperCommand(path, model string) func(context.Context, VoiceSettings) *exec.Cmd {
+	return func(ctx context.Context, voice VoiceSettings) *exec.Cmd {
+		lengthScale := 1.0
+		if voice.SpeakingRate > 0 {
+			lengthScale = 1 / voice.SpeakingRate
+		}
+		return exec.CommandContext(ctx, path,
+			"--model", model,
+			"--length_scale", strconv.FormatFloat(lengthScale, 'f', 2, 64),
+			"--output_file", "-",
+		)
+	}
+}
+
+// espeak voices are named after the language, en-us, en-gb. speed is in words per minute, 175 being normal,
+// and pitch goes from 0 to 99 around 50.
+func espeakCommand(path string) func(context.Context, VoiceSettings) *exec.Cmd {
+	return func(ctx context.Context, voice VoiceSettings) *exec.Cmd {
+		lang := strings.ToLower(voice.selectionParams().LanguageCode)
+		if lang == "" {
+			lang = "en-us"
+		}
+		rate := voice.SpeakingRate
+		if rate <= 0 {
+			rate = 1
+		}
+		pitch := min(max(50+voice.Pitch*2.5, 0), 99)
+		return exec.CommandContext(ctx, path,
+			"-v", lang,
+			"-s", strconv.Itoa(int(175*rate)),
+			"-p", strconv.Itoa(int(pitch)),
+			"--stdout",
+		)
+	}
+}
+
+// lookCommand is the path in env, or the first of names found in PATH.
+func lookCommand(env string, names ...string) (string, error) {
+	if p := os.Getenv(env); p != "" {
+		return p, nil
+	}
+	for _, name := range names {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH, set %s", names[0], env)
+}
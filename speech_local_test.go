@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWhisperPrompt(t *testing.T) {
+	long := make([]string, 200)
+	for i := range long {
+		long[i] = "SessionTermNumber" + strings.Repeat("x", i%7)
+	}
+	tests := []struct {
+		name         string
+		sessionTerms []string
+	}{
+		{name: "no session terms"},
+		{name: "a few session terms", sessionTerms: []string{"Schemaless", "MySQL", "Uber"}},
+		{name: "more session terms than fit", sessionTerms: long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt := whisperPrompt(tt.sessionTerms)
+			if len(prompt) > whisperPromptChars {
+				t.Errorf("prompt is %d characters, over %d", len(prompt), whisperPromptChars)
+			}
+			if len(tt.sessionTerms) == 0 {
+				if !strings.Contains(prompt, systemDesignGlossary[0]) {
+					t.Error("prompt has no glossary terms")
+				}
+				return
+			}
+			// whisper keeps the end of the prompt, the session's terms have to be there
+			if !strings.Contains(prompt, tt.sessionTerms[0]) {
+				t.Errorf("first session term missing: %s", prompt)
+			}
+			first := strings.Index(prompt, tt.sessionTerms[0])
+			for _, g := range systemDesignGlossary[:3] {
+				if i := strings.Index(prompt, g); i > first {
+					t.Errorf("glossary term %q comes after the session terms", g)
+				}
+			}
+		})
+	}
+	if got := whisperPrompt([]string{"Schemaless", "MySQL"}); !strings.HasSuffix(got, ", Schemaless, MySQL.") {
+		t.Errorf("prompt = %q, want the session terms at the end", got)
+	}
+}
+
+func TestWhisperTranscribe(t *testing.T) {
+	var prompt string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prompt = r.FormValue("prompt")
+		json.NewEncoder(w).Encode(map[string]any{
+			"text": "we shard it",
+			"segments": []map[string]any{
+				{"text": " we shard", "end": 1.5, "avg_logprob": -0.1, "words": []map[string]any{
+					{"word": " we", "start": 0.0, "end": 0.4, "probability": 0.9},
+					{"word": " shard", "start": 0.5, "end": 1.5, "probability": 0.5},
+				}},
+				{"text": " ", "end": 2.0, "avg_logprob": -3},
+				{"text": " it", "end": 2.5, "avg_logprob": -0.05},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	ws := &whisperSpeechToText{url: srv.URL, client: srv.Client(), lowConfidence: 0.7}
+	transcript, billed, err := ws.Transcribe(context.Background(), &audioInput{data: []byte("RIFF"), format: "wav"}, []string{"Schemaless"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(prompt, "Schemaless.") {
+		t.Errorf("prompt = %q, want the session term last", prompt)
+	}
+	if billed != 0 {
+		t.Errorf("billed = %v, want 0 for a local server", billed)
+	}
+	if transcript.Text != "we shard it" || len(transcript.Segments) != 2 || len(transcript.Words) != 2 {
+		t.Fatalf("transcript = %+v", transcript)
+	}
+	if transcript.Words[1].Word != "shard" {
+		t.Errorf("word = %q, want it trimmed", transcript.Words[1].Word)
+	}
+	// the two word segment at 0.7 counts twice as much as the one with no words at about 0.95
+	if c := transcript.Confidence; c < 0.78 || c > 0.79 {
+		t.Errorf("confidence = %v, want about 0.783", c)
+	}
+}
@@ -3,75 +3,314 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
-	speech "cloud.google.com/go/speech/apiv1"
-	"cloud.google.com/go/speech/apiv1/speechpb"
+	// v1p1beta1 rather than v1, MP3 uploads are only accepted there
+	"cloud.google.com/go/speech/apiv1p1beta1/speechpb"
 	texttospeech "cloud.google.com/go/texttospeech/apiv1"
 	"cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (cfg *config) convertSpeechToText(ctx context.Context, audioData []byte) (string, error) {
-	client, err := speech.NewClient(ctx)
+// Transcript is everything recognized in one upload. google splits it into segments at pauses.
+type Transcript struct {
+	Text       string  `json:"text"`
+	Confidence float32 `json:"confidence"`
+	// set when the ui should ask the user to confirm what we heard
+	LowConfidence bool                `json:"lowConfidence"`
+	Segments      []TranscriptSegment `json:"segments"`
+	Words         []WordTiming        `json:"words"`
+}
+
+type TranscriptSegment struct {
+	Text       string  `json:"text"`
+	Confidence float32 `json:"confidence"`
+	EndSeconds float64 `json:"endSeconds"`
+}
+
+type WordTiming struct {
+	Word         string  `json:"word"`
+	StartSeconds float64 `json:"startSeconds"`
+	EndSeconds   float64 `json:"endSeconds"`
+	Confidence   float32 `json:"confidence"`
+}
+
+// SpeechToText turns an upload into text. billed is the audio time the backend charges for, zero for the local ones.
+// progress (optional) hears about every finished segment of a long answer, sessionTerms are worth boosting when the backend can.
+type SpeechToText interface {
+	Transcribe(ctx context.Context, audio *audioInput, sessionTerms []string, progress func(sttProgress)) (transcript *Transcript, billed time.Duration, err error)
+}
+
+// TextToSpeech synthesizes one reply, or one sentence of it, in the given format.
+type TextToSpeech interface {
+	Synthesize(ctx context.Context, text string, voice VoiceSettings, encoding ttsEncoding) ([]byte, error)
+	// the formats it can produce, the first is the default
+	Encodings() []ttsEncoding
+}
+
+// convertSpeechToText wraps the configured backend with the span and metrics.
+func (cfg *config) convertSpeechToText(ctx context.Context, audio *audioInput, sessionTerms []string, progress func(sttProgress)) (transcript *Transcript, billed time.Duration, err error) {
+	ctx, span := startSpan(ctx, "convertSpeechToText",
+		attribute.Int("audio.bytes", len(audio.data)),
+		attribute.String("audio.format", audio.format),
+		attribute.String("stt.backend", cfg.sttBackend),
+	)
+	start := time.Now()
+	defer func() {
+		endSpan(span, err)
+		observeSpeech("stt", start, err)
+		if err != nil {
+			errorsTotal.WithLabelValues(causeSpeechToText).Inc()
+		}
+	}()
+	speechBytes.WithLabelValues("stt").Add(float64(len(audio.data)))
+
+	return cfg.stt.Transcribe(ctx, audio, sessionTerms, progress)
+}
+
+type googleSpeechToText struct {
+	newRecognizer func(context.Context) (recognizer, error)
+	// transcripts below this confidence are flagged for the user to confirm
+	lowConfidence float32
+}
+
+// answers too long for a synchronous request are streamed. sessionTerms are boosted on top of the system design glossary.
+func (g googleSpeechToText) Transcribe(ctx context.Context, audio *audioInput, sessionTerms []string, progress func(sttProgress)) (transcript *Transcript, billed time.Duration, err error) {
+	client, err := g.newRecognizer(ctx)
 	if err != nil {
-		log.Println("Falied to create Speech-To-Text client: ", err)
-		return "", fmt.Errorf("failed to create new speect client")
+		slog.ErrorContext(ctx, "failed to create speech-to-text client", "error", err)
+		return nil, 0, fmt.Errorf("failed to create new speect client")
 	}
 	defer client.Close()
 
-	resp, err := client.Recognize(ctx, &speechpb.RecognizeRequest{
-		Config: &speechpb.RecognitionConfig{
-			Encoding:     speechpb.RecognitionConfig_WEBM_OPUS,
-			LanguageCode: "en-US",
-			//this is what the standard seems to be for stereo recodring, also removed sample rate for google to infer it.
-			// should have just made it in the frontend to request a mono channel recording tho
-			AudioChannelCount:                   2,
-			EnableSeparateRecognitionPerChannel: false,
-			//for using better models
-			EnableAutomaticPunctuation: true,
-			UseEnhanced:                true,
-			Model:                      "video",
-		},
-		Audio: &speechpb.RecognitionAudio{
-			AudioSource: &speechpb.RecognitionAudio_Content{Content: audioData},
-		},
-	})
+	recConfig := recognitionConfig(audio, sessionTerms)
+	var results []*speechpb.SpeechRecognitionResult
+
+	streamed := audio.duration > syncRecognizeLimit
+	if streamed {
+		results, billed, err = streamRecognize(ctx, client, recConfig, audio, progress)
+	} else {
+		var resp *speechpb.RecognizeResponse
+		resp, err = client.Recognize(ctx, &speechpb.RecognizeRequest{
+			Config: recConfig,
+			Audio: &speechpb.RecognitionAudio{
+				AudioSource: &speechpb.RecognitionAudio_Content{Content: audio.data},
+			},
+		})
+		if isAudioTooLong(err) {
+			slog.InfoContext(ctx, "audio too long for a synchronous request, streaming it instead", "format", audio.format)
+			streamed = true
+			results, billed, err = streamRecognize(ctx, client, recConfig, audio, progress)
+		} else if err == nil {
+			results, billed = resp.Results, resp.GetTotalBilledTime().AsDuration()
+		}
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("audio.streamed", streamed))
 	if err != nil {
-		log.Println("Failed to recognize speech: ", err)
-		return "", fmt.Errorf("failed to recognize speech")
+		slog.ErrorContext(ctx, "failed to recognize speech", "error", err)
+		return nil, billed, fmt.Errorf("failed to recognize speech")
 	}
 
-	if len(resp.Results) > 0 && len(resp.Results[0].Alternatives) > 0 {
-		return resp.Results[0].Alternatives[0].Transcript, nil
+	transcript = buildTranscript(results, g.lowConfidence)
+	if transcript == nil {
+		return nil, billed, fmt.Errorf("no transcript found")
 	}
+	return transcript, billed, nil
+}
+
+func recognitionConfig(audio *audioInput, sessionTerms []string) *speechpb.RecognitionConfig {
+	return &speechpb.RecognitionConfig{
+		Encoding:        audio.encoding,
+		SampleRateHertz: audio.sampleRate,
+		LanguageCode:    "en-US",
+		// channels come from the upload's header now, multi channel recordings are still one speaker
+		AudioChannelCount:                   audio.channels,
+		EnableSeparateRecognitionPerChannel: false,
+		//for using better models
+		EnableAutomaticPunctuation: true,
+		UseEnhanced:                true,
+		Model:                      "video",
+		// timings and per word confidence for the transcript we hand back
+		EnableWordTimeOffsets: true,
+		EnableWordConfidence:  true,
+		// so "kafka" and "p99" dont come back as "car ca" and "p 99"
+		SpeechContexts: speechContexts(sessionTerms),
+	}
+}
+
+// buildTranscript joins the best alternative of every result, google starts a new result after each pause.
+// returns nil when nothing was recognized.
+func buildTranscript(results []*speechpb.SpeechRecognitionResult, lowConfidence float32) *Transcript {
+	segments := make([]recognizedSegment, 0, len(results))
+	for _, result := range results {
+		if len(result.Alternatives) == 0 {
+			continue
+		}
+		best := result.Alternatives[0]
+		rs := recognizedSegment{text: best.Transcript, confidence: best.Confidence, endSeconds: result.GetResultEndTime().AsDuration().Seconds()}
+		for _, w := range best.Words {
+			rs.words = append(rs.words, WordTiming{
+				Word:         w.Word,
+				StartSeconds: w.GetStartTime().AsDuration().Seconds(),
+				EndSeconds:   w.GetEndTime().AsDuration().Seconds(),
+				Confidence:   w.Confidence,
+			})
+		}
+		segments = append(segments, rs)
+	}
+	return assembleTranscript(segments, lowConfidence)
+}
 
-	return "", fmt.Errorf("no transcript found")
+// recognizedSegment is one stretch of speech as a backend recognized it, before it is put in a Transcript.
+type recognizedSegment struct {
+	text       string
+	confidence float32
+	endSeconds float64
+	words      []WordTiming
 }
 
-func (cfg *config) convertTextToSpeech(ctx context.Context, text string) ([]byte, error) {
+// assembleTranscript joins the segments every backend hands back into one Transcript, nil when nothing was said.
+func assembleTranscript(segments []recognizedSegment, lowConfidence float32) *Transcript {
+	t := &Transcript{Segments: []TranscriptSegment{}, Words: []WordTiming{}}
+	var texts []string
+	var weighted, weight float32
+
+	for _, seg := range segments {
+		text := strings.TrimSpace(seg.text)
+		if text == "" {
+			continue
+		}
+
+		texts = append(texts, text)
+		t.Segments = append(t.Segments, TranscriptSegment{Text: text, Confidence: seg.confidence, EndSeconds: seg.endSeconds})
+		words := 0
+		for _, w := range seg.words {
+			if w.Word == "" {
+				continue
+			}
+			t.Words = append(t.Words, w)
+			words++
+		}
+
+		// longer segments count for more, a shaky "um" shouldnt flag a whole answer
+		n := float32(max(words, 1))
+		weighted += seg.confidence * n
+		weight += n
+	}
+
+	if len(texts) == 0 {
+		return nil
+	}
+	t.Text = strings.Join(texts, " ")
+	t.Confidence = weighted / weight
+	t.LowConfidence = t.Confidence < lowConfidence
+	return t
+}
+
+// convertTextToSpeech wraps the configured backend with the span and metrics.
+func (cfg *config) convertTextToSpeech(ctx context.Context, text string, voice VoiceSettings, encoding ttsEncoding) (audio []byte, err error) {
+	ctx, span := startSpan(ctx, "convertTextToSpeech",
+		attribute.Int("text.chars", len(text)),
+		attribute.String("tts.backend", cfg.ttsBackend),
+		attribute.String("tts.voice", voice.Name),
+		attribute.String("tts.encoding", encoding.contentType),
+	)
+	start := time.Now()
+	defer func() {
+		endSpan(span, err)
+		observeSpeech("tts", start, err)
+		if err != nil {
+			errorsTotal.WithLabelValues(causeTextToSpeech).Inc()
+		}
+	}()
+
+	audio, err = cfg.tts.Synthesize(ctx, text, voice, encoding)
+	if err != nil {
+		return nil, err
+	}
+	speechBytes.WithLabelValues("tts").Add(float64(len(audio)))
+	return audio, nil
+}
+
+type googleTextToSpeech struct{}
+
+func (googleTextToSpeech) Synthesize(ctx context.Context, text string, voice VoiceSettings, encoding ttsEncoding) ([]byte, error) {
 	client, err := texttospeech.NewClient(ctx)
 	if err != nil {
-		log.Printf("Failed to create Text-to-Speech client: %v", err)
+		slog.ErrorContext(ctx, "failed to create text-to-speech client", "error", err)
 		return nil, fmt.Errorf("failed to create tts client")
 	}
 	defer client.Close()
 
+	input := &texttospeechpb.SynthesisInput{InputSource: &texttospeechpb.SynthesisInput_Text{Text: text}}
+	if ssml := toSSML(text); len(ssml) <= maxSSMLBytes {
+		input.InputSource = &texttospeechpb.SynthesisInput_Ssml{Ssml: ssml}
+	}
+
 	resp, err := client.SynthesizeSpeech(ctx, &texttospeechpb.SynthesizeSpeechRequest{
-		Input: &texttospeechpb.SynthesisInput{
-			InputSource: &texttospeechpb.SynthesisInput_Text{Text: text},
-		},
-		Voice: &texttospeechpb.VoiceSelectionParams{
-			LanguageCode: "en-US",
-			Name:         "en-US-Wavenet-F",
-		},
+		Input: input,
+		Voice: voice.selectionParams(),
 		AudioConfig: &texttospeechpb.AudioConfig{
-			AudioEncoding: texttospeechpb.AudioEncoding_MP3,
+			AudioEncoding: encoding.encoding,
+			SpeakingRate:  voice.SpeakingRate,
+			Pitch:         voice.Pitch,
 		},
 	})
 	if err != nil {
-		log.Printf("Failed to synthesize speech: %v", err)
+		slog.ErrorContext(ctx, "failed to synthesize speech", "error", err)
 		return nil, fmt.Errorf("failed to synthesize speech")
 	}
-
 	return resp.AudioContent, nil
 }
+
+func (googleTextToSpeech) Encodings() []ttsEncoding {
+	return ttsEncodings
+}
+
+// speechBackends builds the backends named by STT_BACKEND ("google" or "whisper") and TTS_BACKEND
+// ("google", "piper" or "espeak"), so audio mode works without google credentials.
+func (cfg *config) speechBackends(lowConfidence float32) error {
+	cfg.sttBackend = envString("STT_BACKEND", "google")
+	switch cfg.sttBackend {
+	case "google":
+		cfg.stt = googleSpeechToText{newRecognizer: newGoogleRecognizer, lowConfidence: lowConfidence}
+	case "whisper":
+		url := os.Getenv("WHISPER_URL")
+		if url == "" {
+			return fmt.Errorf("WHISPER_URL must be set for the whisper backend")
+		}
+		cfg.stt = &whisperSpeechToText{url: url, ffmpegPath: cfg.ffmpegPath, lowConfidence: lowConfidence, client: &http.Client{}}
+	default:
+		return fmt.Errorf("unknown STT_BACKEND %q", cfg.sttBackend)
+	}
+
+	cfg.ttsBackend = envString("TTS_BACKEND", "google")
+	switch cfg.ttsBackend {
+	case "google":
+		cfg.tts = googleTextToSpeech{}
+	case "piper":
+		model := os.Getenv("PIPER_MODEL")
+		if model == "" {
+			return fmt.Errorf("PIPER_MODEL must be set for the piper backend")
+		}
+		path, err := lookCommand("PIPER_PATH", "piper")
+		if err != nil {
+			return err
+		}
+		cfg.tts = &localTextToSpeech{command: piperCommand(path, model), ffmpegPath: cfg.ffmpegPath}
+	case "espeak":
+		path, err := lookCommand("ESPEAK_PATH", "espeak-ng", "espeak")
+		if err != nil {
+			return err
+		}
+		cfg.tts = &localTextToSpeech{command: espeakCommand(path), ffmpegPath: cfg.ffmpegPath}
+	default:
+		return fmt.Errorf("unknown TTS_BACKEND %q", cfg.ttsBackend)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAssembleTranscript(t *testing.T) {
+	words := func(n int) []WordTiming {
+		w := make([]WordTiming, n)
+		for i := range w {
+			w[i] = WordTiming{Word: "word"}
+		}
+		return w
+	}
+	tests := []struct {
+		name           string
+		segments       []recognizedSegment
+		wantNil        bool
+		wantText       string
+		wantConfidence float32
+		wantLow        bool
+	}{
+		{name: "nothing", wantNil: true},
+		{name: "only blanks", segments: []recognizedSegment{{text: "  "}, {text: ""}}, wantNil: true},
+		{
+			name:           "weighted by words",
+			segments:       []recognizedSegment{{text: " long answer ", confidence: 0.9, words: words(9)}, {text: "um", confidence: 0.1, words: words(1)}},
+			wantText:       "long answer um",
+			wantConfidence: 0.82,
+		},
+		{
+			name:           "segments without words count once",
+			segments:       []recognizedSegment{{text: "a", confidence: 0.4}, {text: "b", confidence: 0.6}},
+			wantText:       "a b",
+			wantConfidence: 0.5,
+			wantLow:        true,
+		},
+		{
+			name:           "empty words are dropped",
+			segments:       []recognizedSegment{{text: "a", confidence: 0.8, words: []WordTiming{{Word: ""}, {Word: "a"}}}},
+			wantText:       "a",
+			wantConfidence: 0.8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := assembleTranscript(tt.segments, 0.7)
+			if tt.wantNil {
+				if got != nil {
+					t.Fatalf("got %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("got nil")
+			}
+			if got.Text != tt.wantText {
+				t.Errorf("text = %q, want %q", got.Text, tt.wantText)
+			}
+			if d := got.Confidence - tt.wantConfidence; d > 0.001 || d < -0.001 {
+				t.Errorf("confidence = %v, want %v", got.Confidence, tt.wantConfidence)
+			}
+			if got.LowConfidence != tt.wantLow {
+				t.Errorf("lowConfidence = %v, want %v", got.LowConfidence, tt.wantLow)
+			}
+			for _, w := range got.Words {
+				if w.Word == "" {
+					t.Error("empty word kept")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// google rejects ssml over 5000 bytes, plain text is sent instead then
+const maxSSMLBytes = 5000
+
+const (
+	paragraphBreak = "600ms"
+	listItemBreak  = "350ms"
+	questionBreak  = "400ms"
+)
+
+// how the interviewer should say the shorthand the model uses. an empty value spells the word out letter by letter.
+var spokenTerms = map[string]string{
+	"QPS": "", "RPS": "", "TPS": "", "API": "", "APIs": "A P Is", "CDN": "", "CDNs": "C D Ns", "DNS": "", "TCP": "", "UDP": "",
+	"HTTP": "", "HTTPS": "", "URL": "", "URLs": "U R Ls", "SQL": "", "NoSQL": "no sequel", "AWS": "", "GCP": "", "CPU": "", "GPU": "",
+	"RAM": "", "SSD": "", "HDD": "", "IO": "", "ID": "", "IDs": "I Ds", "UUID": "", "JWT": "", "LRU": "", "LFU": "", "TTL": "",
+	"SLA": "", "SLO": "", "SLI": "", "OLTP": "", "OLAP": "", "ETL": "", "CDC": "", "RPC": "", "gRPC": "g R P C", "SQS": "", "SNS": "",
+	"S3": "", "EC2": "", "ECS": "", "EKS": "", "VM": "", "VMs": "V Ms", "P2P": "peer to peer", "OTP": "", "TOTP": "", "CRUD": "crud",
+	"DB": "database", "DBs": "databases", "db": "database", "K8s": "Kubernetes", "k8s": "Kubernetes",
+	"vs": "versus", "eg": "for example", "ie": "that is", "etc": "et cetera", "approx": "approximately",
+	"async": "asynchronous", "repo": "repository", "config": "configuration",
+}
+
+// units after a number, 100ms, 10k, 5GB
+var spokenUnits = map[string]string{
+	"ms": "milliseconds", "k": "thousand", "K": "thousand", "M": "million", "B": "billion",
+	"KB": "kilobytes", "MB": "megabytes", "GB": "gigabytes", "TB": "terabytes", "PB": "petabytes",
+}
+
+var (
+	speechToken = regexp.MustCompile(`\b[0-9]+(?:\.[0-9]+)?[A-Za-z]+\b|\b[A-Za-z][A-Za-z0-9]*\b`)
+	numberUnit  = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([A-Za-z]+)$`)
+	// p50, p99, p999
+	percentile = regexp.MustCompile(`^p([0-9]{2,3})$`)
+	// user_id, created_at
+	snakeCase  = regexp.MustCompile(`\b[A-Za-z0-9]+(?:_[A-Za-z0-9]+)+\b`)
+	listMarker = regexp.MustCompile(`^\s*(?:[-*•+]|[0-9]+[.)])\s+`)
+	// abbreviations whose dots would end a sentence
+	dottedAbbrev = strings.NewReplacer("e.g.", "eg", "i.e.", "ie", "etc.", "etc", "vs.", "vs", "approx.", "approx")
+	// markdown and the symbols tts reads out loud
+	mangled = strings.NewReplacer("*", "", "`", "", "#", "", "~", "", "|", " ", "_", " ", "{", "", "}", "", "[", "", "]", "")
+)
+
+// toSSML turns a model reply into ssml: pauses between paragraphs, list items and questions, the
+// shorthand expanded or spelled out, and the last question emphasized since that is what the user has to answer.
+func toSSML(text string) string {
+	blocks := speechBlocks(text)
+
+	// the key question is the last one asked
+	keyBlock, keySentence := -1, -1
+	for i, block := range blocks {
+		for j, s := range block.sentences {
+			if strings.HasSuffix(s, "?") {
+				keyBlock, keySentence = i, j
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("<speak>")
+	for i, block := range blocks {
+		if i > 0 {
+			pause := paragraphBreak
+			if block.listItem {
+				pause = listItemBreak
+			}
+			b.WriteString(`<break time="` + pause + `"/>`)
+		}
+		for j, s := range block.sentences {
+			if j > 0 {
+				b.WriteString(" ")
+			}
+			if i == keyBlock && j == keySentence {
+				b.WriteString(`<emphasis level="moderate">` + speakSentence(s) + `</emphasis>`)
+			} else {
+				b.WriteString(speakSentence(s))
+			}
+			if strings.HasSuffix(s, "?") && j < len(block.sentences)-1 {
+				b.WriteString(`<break time="` + questionBreak + `"/>`)
+			}
+		}
+	}
+	b.WriteString("</speak>")
+	return b.String()
+}
+
+type speechBlock struct {
+	sentences []string
+	listItem  bool
+}
+
+// speechBlocks cleans the text up and splits it into paragraphs and list items, each split into sentences.
+func speechBlocks(text string) []speechBlock {
+	var blocks []speechBlock
+	var current []string
+	listItem := false
+	flush := func() {
+		if len(current) > 0 {
+			blocks = append(blocks, speechBlock{sentences: splitSentences(strings.Join(current, " ")), listItem: listItem})
+		}
+		current, listItem = nil, false
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		if listMarker.MatchString(line) {
+			flush()
+			line = listMarker.ReplaceAllString(line, "")
+			listItem = true
+		}
+		line = cleanForSpeech(line)
+		if line == "" {
+			flush()
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+	return blocks
+}
+
+func cleanForSpeech(line string) string {
+	line = dottedAbbrev.Replace(line)
+	line = snakeCase.ReplaceAllStringFunc(line, func(s string) string { return strings.ReplaceAll(s, "_", " ") })
+	line = mangled.Replace(line)
+	// quote markers at the start of the line
+	line = strings.TrimLeft(line, "> ")
+	return strings.Join(strings.Fields(line), " ")
+}
+
+// splitSentences breaks after . ! or ? when the next word starts a new sentence.
+func splitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+	start := 0
+	for i, r := range runes {
+		if r != '.' && r != '!' && r != '?' {
+			continue
+		}
+		// 3.5 or google.com
+		if i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			continue
+		}
+		next := i + 1
+		for next < len(runes) && unicode.IsSpace(runes[next]) {
+			next++
+		}
+		if next < len(runes) && unicode.IsLower(runes[next]) {
+			continue
+		}
+		if s := strings.TrimSpace(string(runes[start : i+1])); s != "" {
+			sentences = append(sentences, s)
+		}
+		start = i + 1
+	}
+	if s := strings.TrimSpace(string(runes[start:])); s != "" {
+		sentences = append(sentences, s)
+	}
+	return sentences
+}
+
+// speakSentence escapes the sentence for ssml, replacing the terms tts gets wrong on the way.
+func speakSentence(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range speechToken.FindAllStringIndex(s, -1) {
+		b.WriteString(escapeSSML(s[last:loc[0]]))
+		b.WriteString(speakToken(s[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	b.WriteString(escapeSSML(s[last:]))
+	return b.String()
+}
+
+func speakToken(token string) string {
+	if spoken, ok := spokenTerms[token]; ok {
+		if spoken == "" {
+			return `<say-as interpret-as="characters">` + token + `</say-as>`
+		}
+		return escapeSSML(spoken)
+	}
+	if m := percentile.FindStringSubmatch(token); m != nil {
+		return "p " + m[1]
+	}
+	if m := numberUnit.FindStringSubmatch(token); m != nil {
+		if unit, ok := spokenUnits[m[2]]; ok {
+			return m[1] + " " + unit
+		}
+	}
+	return escapeSSML(token)
+}
+
+var ssmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
+func escapeSSML(s string) string {
+	return ssmlEscaper.Replace(s)
+}
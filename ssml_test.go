@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestToSSML(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "last question emphasized",
+			text: "Good start. How would you shard it?",
+			want: `<speak>Good start. <emphasis level="moderate">How would you shard it?</emphasis></speak>`,
+		},
+		{
+			name: "pause after a question that is not the last sentence",
+			text: "Why Redis? Think about memory. What else?",
+			want: `<speak>Why Redis?<break time="400ms"/> Think about memory. <emphasis level="moderate">What else?</emphasis></speak>`,
+		},
+		{
+			name: "paragraphs and list items",
+			text: "Two options:\n\n- a queue\n- a log\n\nWhich one?",
+			want: `<speak>Two options:<break time="350ms"/>a queue<break time="350ms"/>a log<break time="600ms"/><emphasis level="moderate">Which one?</emphasis></speak>`,
+		},
+		{
+			name: "markdown and snake case",
+			text: "**Use** the `user_id` as the key.",
+			want: `<speak>Use the user id as the key.</speak>`,
+		},
+		{
+			name: "shorthand",
+			text: "At 10k QPS the DB needs a CDN, e.g. for p99 under 100ms.",
+			want: `<speak>At 10 thousand <say-as interpret-as="characters">QPS</say-as> the database needs a <say-as interpret-as="characters">CDN</say-as>, for example for p 99 under 100 milliseconds.</speak>`,
+		},
+		{
+			name: "unknown units and numbers are left alone",
+			text: "Version 3.5 with 4xyz.",
+			want: `<speak>Version 3.5 with 4xyz.</speak>`,
+		},
+		{
+			name: "escaped",
+			text: `Is a < b & "c" fine?`,
+			want: `<speak><emphasis level="moderate">Is a &lt; b &amp; &quot;c&quot; fine?</emphasis></speak>`,
+		},
+		{
+			name: "empty",
+			text: "",
+			want: `<speak></speak>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toSSML(tt.text); got != tt.want {
+				t.Errorf("toSSML(%q)\n got  %s\n want %s", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// whatever the model writes, google has to be able to parse it
+func TestToSSMLIsWellFormed(t *testing.T) {
+	for _, text := range []string{
+		"<script>alert('x')</script>",
+		"a && b || c > d",
+		"# Heading\n> quoted\n1. first\n2) second\n* third",
+		"What's the TTL? And the LRU's size?",
+	} {
+		dec := xml.NewDecoder(strings.NewReader(toSSML(text)))
+		for {
+			_, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("toSSML(%q) is not valid xml: %v", text, err)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"One. Two! Three?", []string{"One.", "Two!", "Three?"}},
+		{"Use google.com or 3.5 replicas. Then stop.", []string{"Use google.com or 3.5 replicas.", "Then stop."}},
+		// a lowercase word after the dot keeps the sentence going
+		{"Put it in a cache, e.g. redis. Done.", []string{"Put it in a cache, e.g. redis.", "Done."}},
+		{"no end", []string{"no end"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := splitSentences(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("splitSentences(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
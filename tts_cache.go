@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bump when the text sent to google changes for the same input, e.g. the ssml rules, so old audio isnt served
+const ttsCacheVersion = 1
+
+var ttsCacheKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ttsCache keeps synthesized audio by a hash of everything that went into it. the most recent
+// maxBytes live in memory, and everything is also written to dir when one is configured so it
+// survives restarts. nothing prunes dir, point it at something that gets cleaned up.
+type ttsCache struct {
+	maxBytes int64
+	dir      string
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type ttsCacheEntry struct {
+	key      string
+	audio    []byte
+	encoding ttsEncoding
+}
+
+// newTTSCache returns nil when both the memory and disk caches are off, a nil cache misses every lookup.
+func newTTSCache(maxBytes int64, dir string) *ttsCache {
+	if maxBytes <= 0 && dir == "" {
+		return nil
+	}
+	return &ttsCache{
+		maxBytes: maxBytes,
+		dir:      dir,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func ttsCacheKey(backend, text string, voice VoiceSettings, encoding ttsEncoding) string {
+	h := sha256.New()
+	// unit separators so "ab"+"c" and "a"+"bc" hash differently
+	fmt.Fprintf(h, "%d\x1f%s\x1f%s\x1f%s\x1f%g\x1f%g\x1f%s\x1f%s",
+		ttsCacheVersion, backend, voice.LanguageCode, voice.Name, voice.SpeakingRate, voice.Pitch, encoding.contentType, text)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *ttsCache) get(ctx context.Context, key string) (audio []byte, encoding ttsEncoding, ok bool) {
+	if c == nil {
+		return nil, ttsEncoding{}, false
+	}
+
+	c.mu.Lock()
+	if el, found := c.items[key]; found {
+		c.ll.MoveToFront(el)
+		entry := el.Value.(*ttsCacheEntry)
+		c.mu.Unlock()
+		ttsCacheLookups.WithLabelValues("memory").Inc()
+		return entry.audio, entry.encoding, true
+	}
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		for _, e := range ttsEncodings {
+			audio, err := os.ReadFile(c.path(key, e))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "failed to read tts cache file", "error", err)
+				break
+			}
+			c.remember(key, audio, e)
+			ttsCacheLookups.WithLabelValues("disk").Inc()
+			return audio, e, true
+		}
+	}
+
+	ttsCacheLookups.WithLabelValues("miss").Inc()
+	return nil, ttsEncoding{}, false
+}
+
+func (c *ttsCache) put(ctx context.Context, key string, audio []byte, encoding ttsEncoding) {
+	if c == nil {
+		return
+	}
+	c.remember(key, audio, encoding)
+
+	if c.dir == "" {
+		return
+	}
+	// best effort, the audio was already synthesized and goes out either way
+	if err := c.writeFile(key, audio, encoding); err != nil {
+		slog.WarnContext(ctx, "failed to write tts cache file", "error", err)
+	}
+}
+
+func (c *ttsCache) remember(key string, audio []byte, encoding ttsEncoding) {
+	if int64(len(audio)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.items[key]; found {
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&ttsCacheEntry{key: key, audio: audio, encoding: encoding})
+	c.size += int64(len(audio))
+
+	for c.size > c.maxBytes {
+		oldest := c.ll.Back()
+		entry := oldest.Value.(*ttsCacheEntry)
+		c.ll.Remove(oldest)
+		delete(c.items, entry.key)
+		c.size -= int64(len(entry.audio))
+	}
+}
+
+// two levels of directories so a big cache doesnt end up as one huge directory
+func (c *ttsCache) path(key string, encoding ttsEncoding) string {
+	return filepath.Join(c.dir, key[:2], key+encoding.ext)
+}
+
+func (c *ttsCache) writeFile(key string, audio []byte, encoding ttsEncoding) error {
+	path := c.path(key, encoding)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// rename so a concurrent reader never sees half a file
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(audio)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// serveAudio writes cached or fresh audio with its etag, answering If-None-Match and Range requests.
+func serveAudio(w http.ResponseWriter, r *http.Request, key string, audio []byte, encoding ttsEncoding) {
+	etag := `"` + key + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", encoding.contentType)
+	// the key covers the text, voice and format, the audio behind it never changes
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+
+	// ServeContent only answers If-None-Match with a 304 for GET, /tts is a POST
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// ServeContent sets Content-Length and Accept-Ranges and handles Range and If-Range
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(audio))
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ttsAudioHandler serves audio synthesized earlier by /tts, so <audio> elements can point at it and seek.
+func (cfg *config) ttsAudioHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !ttsCacheKeyPattern.MatchString(key) {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Audio not found"})
+		return
+	}
+	audio, encoding, ok := cfg.ttsCache.get(r.Context(), key)
+	if !ok {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Audio not found"})
+		return
+	}
+	serveAudio(w, r, key, audio, encoding)
+}
+
+// ttsCacheMaxBytes reads TTS_CACHE_MB, 0 keeps nothing in memory.
+func ttsCacheMaxBytes() int64 {
+	return int64(envInt("TTS_CACHE_MB", 64)) << 20
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTTSCacheKey(t *testing.T) {
+	mp3, ogg := ttsEncodings[0], ttsEncodings[1]
+	voice := VoiceSettings{LanguageCode: "en-US", Name: "en-US-Neural2-D", SpeakingRate: 1, Pitch: 0}
+	base := ttsCacheKey("google", "hello", voice, mp3)
+	if !ttsCacheKeyPattern.MatchString(base) {
+		t.Fatalf("key %q does not match the audio url pattern", base)
+	}
+	if ttsCacheKey("google", "hello", voice, mp3) != base {
+		t.Error("same input, different key")
+	}
+
+	faster, lower, other := voice, voice, voice
+	faster.SpeakingRate = 1.25
+	lower.Pitch = -2
+	other.Name = "en-US-Neural2-F"
+	for name, key := range map[string]string{
+		"text":     ttsCacheKey("google", "hello!", voice, mp3),
+		"backend":  ttsCacheKey("piper", "hello", voice, mp3),
+		"encoding": ttsCacheKey("google", "hello", voice, ogg),
+		"rate":     ttsCacheKey("google", "hello", faster, mp3),
+		"pitch":    ttsCacheKey("google", "hello", lower, mp3),
+		"voice":    ttsCacheKey("google", "hello", other, mp3),
+	} {
+		if key == base {
+			t.Errorf("a different %s gives the same key", name)
+		}
+	}
+}
+
+func TestTTSCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	mp3 := ttsEncodings[0]
+	c := newTTSCache(10, "")
+	c.put(ctx, "a", []byte("aaaa"), mp3)
+	c.put(ctx, "b", []byte("bbbb"), mp3)
+	// a was used last, so b goes when c needs the room
+	c.get(ctx, "a")
+	c.put(ctx, "c", []byte("cccc"), mp3)
+
+	if _, _, ok := c.get(ctx, "b"); ok {
+		t.Error("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := c.get(ctx, key); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+	if c.size != 8 {
+		t.Errorf("size = %d, want 8", c.size)
+	}
+
+	// bigger than the whole cache, kept out instead of emptying it
+	c.put(ctx, "huge", bytes.Repeat([]byte("x"), 11), mp3)
+	if _, _, ok := c.get(ctx, "huge"); ok {
+		t.Error("audio bigger than the cache was kept")
+	}
+	if _, _, ok := c.get(ctx, "a"); !ok {
+		t.Error("a big entry pushed the others out")
+	}
+}
+
+func TestTTSCacheOff(t *testing.T) {
+	if c := newTTSCache(0, ""); c != nil {
+		t.Fatal("no memory and no dir should turn the cache off")
+	}
+	var c *ttsCache
+	c.put(context.Background(), "a", []byte("a"), ttsEncodings[0])
+	if _, _, ok := c.get(context.Background(), "a"); ok {
+		t.Error("a nil cache should miss")
+	}
+}
+
+func TestTTSCacheDisk(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ogg := ttsEncodings[1]
+	key := ttsCacheKey("google", "hello", VoiceSettings{}, ogg)
+
+	newTTSCache(0, dir).put(ctx, key, []byte("opus"), ogg)
+	if _, err := os.Stat(filepath.Join(dir, key[:2], key+".ogg")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart finds it on disk, with the format it was made in
+	restarted := newTTSCache(1<<20, dir)
+	audio, encoding, ok := restarted.get(ctx, key)
+	if !ok || string(audio) != "opus" || encoding != ogg {
+		t.Fatalf("got %q, %v, %v, want the ogg audio from disk", audio, encoding.contentType, ok)
+	}
+	if restarted.size != 4 {
+		t.Error("audio read from disk was not kept in memory")
+	}
+	if _, _, ok := restarted.get(ctx, strings.Repeat("0", 64)); ok {
+		t.Error("unknown key was found")
+	}
+}
+
+func TestServeAudio(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	audio := []byte("0123456789")
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		rangeHeader string
+		wantCode    int
+		wantBody    string
+	}{
+		{name: "plain", wantCode: http.StatusOK, wantBody: "0123456789"},
+		{name: "matching etag", ifNoneMatch: `"` + key + `"`, wantCode: http.StatusNotModified},
+		{name: "weak etag in a list", ifNoneMatch: `"other", W/"` + key + `"`, wantCode: http.StatusNotModified},
+		{name: "star", ifNoneMatch: "*", wantCode: http.StatusNotModified},
+		{name: "other etag", ifNoneMatch: `"other"`, wantCode: http.StatusOK, wantBody: "0123456789"},
+		{name: "range", rangeHeader: "bytes=2-5", wantCode: http.StatusPartialContent, wantBody: "2345"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// /tts is a POST, the etag still has to work for it
+			r := httptest.NewRequest(http.MethodPost, "/tts", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.rangeHeader != "" {
+				r.Header.Set("Range", tt.rangeHeader)
+			}
+			w := httptest.NewRecorder()
+			serveAudio(w, r, key, audio, ttsEncodings[0])
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := w.Header().Get("ETag"); got != `"`+key+`"` {
+				t.Errorf("ETag = %q", got)
+			}
+			if got := w.Header().Get("Content-Type"); got != "audio/mpeg" {
+				t.Errorf("Content-Type = %q", got)
+			}
+		})
+	}
+}
+
+func TestTTSAudioHandler(t *testing.T) {
+	key := ttsCacheKey("google", "hello", VoiceSettings{}, ttsEncodings[0])
+	cfg := &config{ttsCache: newTTSCache(1<<20, "")}
+	cfg.ttsCache.put(context.Background(), key, []byte("mp3"), ttsEncodings[0])
+
+	tests := []struct {
+		name     string
+		key      string
+		wantCode int
+	}{
+		{name: "cached", key: key, wantCode: http.StatusOK},
+		{name: "unknown", key: strings.Repeat("0", 64), wantCode: http.StatusNotFound},
+		{name: "not a key", key: "../../etc/passwd", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/tts/audio/x", nil)
+			r.SetPathValue("key", tt.key)
+			w := httptest.NewRecorder()
+			cfg.ttsAudioHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"unicode/utf8"
+)
+
+// mp3 frames and chained ogg streams can be played back to back, wav files with a header each cannot
+var streamableEncodings = []ttsEncoding{ttsEncodings[0], ttsEncodings[1]}
+
+// sentences shorter than this ride along with the next one in the paragraph, "Great." is not worth its own request
+const minSpeechChunk = 40
+
+// speechChunks splits a reply into the pieces /tts/stream synthesizes one by one.
+func speechChunks(text string) []string {
+	var chunks []string
+	var pending string
+	for _, block := range speechBlocks(text) {
+		for _, s := range block.sentences {
+			if pending != "" {
+				s = pending + " " + s
+			}
+			if utf8.RuneCountInString(s) < minSpeechChunk {
+				pending = s
+				continue
+			}
+			chunks = append(chunks, s)
+			pending = ""
+		}
+		// not across paragraphs or list items, the pause between them would be lost
+		if pending != "" {
+			chunks = append(chunks, pending)
+			pending = ""
+		}
+	}
+	return chunks
+}
+
+type synthesized struct {
+	audio []byte
+	// true when google was called, for the usage
+	fresh bool
+	err   error
+}
+
+// synthesize goes through the tts cache.
+func (cfg *config) synthesize(ctx context.Context, text string, voice VoiceSettings, encoding ttsEncoding) synthesized {
+	key := ttsCacheKey(cfg.ttsBackend, text, voice, encoding)
+	if audio, _, ok := cfg.ttsCache.get(ctx, key); ok {
+		return synthesized{audio: audio}
+	}
+	audio, err := cfg.convertTextToSpeech(ctx, text, voice, encoding)
+	if err != nil {
+		return synthesized{err: err}
+	}
+	cfg.ttsCache.put(ctx, key, audio, encoding)
+	return synthesized{audio: audio, fresh: true}
+}
+
+// ttsStreamHandler synthesizes a reply sentence by sentence, a few at a time, and writes the audio
+// in order as each one is ready, so playback can start after the first sentence.
+func (cfg *config) ttsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	req, session, voice, ok := decodeTtsRequest(w, r)
+	if !ok {
+		return
+	}
+
+	supported := onlyEncodings(cfg.tts.Encodings(), streamableEncodings)
+	encoding, ok := negotiateEncoding(r.Header.Get("Accept"), supported)
+	if !ok {
+		notAcceptable(w, supported)
+		return
+	}
+
+	chunks := speechChunks(req.Text)
+	if len(chunks) == 0 {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Text has nothing to say"})
+		return
+	}
+
+	// the whole reply is checked upfront, failing halfway through the audio is worse than not starting
+	uid := userID(r)
+	if cfg.quota.ttsCharsExceeded(uid, int64(utf8.RuneCountInString(req.Text))) {
+		respondQuotaExceeded(w)
+		return
+	}
+
+	// stops the sentences still in flight when the client goes away or one of them fails
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	results := make([]chan synthesized, len(chunks))
+	sem := make(chan struct{}, max(cfg.ttsStreamParallelism, 1))
+	for i, chunk := range chunks {
+		results[i] = make(chan synthesized, 1)
+		go func() {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] <- synthesized{err: ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
+			results[i] <- cfg.synthesize(ctx, chunk, voice, encoding)
+		}()
+	}
+
+	rc := http.NewResponseController(w)
+	var chars int64
+	done := 0
+	defer func() {
+		// sentences synthesized but never written out are paid for all the same
+		cancel()
+		for i := done; i < len(results); i++ {
+			if res := <-results[i]; res.fresh {
+				chars += int64(utf8.RuneCountInString(chunks[i]))
+			}
+		}
+		recordUsage(uid, session, Usage{TtsCharacters: chars})
+	}()
+
+	for i, result := range results {
+		res := <-result
+		done = i + 1
+		if res.fresh {
+			chars += int64(utf8.RuneCountInString(chunks[i]))
+		}
+		if res.err != nil {
+			if i == 0 {
+				respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to generate audio"})
+				return
+			}
+			// the status line is long gone, all we can do is stop, the client sees the audio end early
+			slog.ErrorContext(ctx, "failed to synthesize sentence, ending the stream early", "sentence", i, "of", len(chunks), "error", res.err)
+			return
+		}
+
+		if i == 0 {
+			w.Header().Set("Content-Type", encoding.contentType)
+			w.Header().Add("Vary", "Accept")
+			w.WriteHeader(http.StatusOK)
+		}
+		if _, err := w.Write(res.audio); err != nil {
+			return
+		}
+		rc.Flush()
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// fakeTTS returns "<text>" as the audio for a sentence, or an error for sentences containing fail.
+type fakeTTS struct {
+	fail  string
+	delay func(text string) time.Duration
+
+	mu         sync.Mutex
+	done       []string
+	running    int
+	maxRunning int
+}
+
+func (f *fakeTTS) Synthesize(ctx context.Context, text string, voice VoiceSettings, encoding ttsEncoding) ([]byte, error) {
+	f.mu.Lock()
+	f.running++
+	f.maxRunning = max(f.maxRunning, f.running)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.running--
+		f.mu.Unlock()
+	}()
+
+	if f.delay != nil {
+		select {
+		case <-time.After(f.delay(text)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if f.fail != "" && strings.Contains(text, f.fail) {
+		return nil, errors.New("synthesis failed")
+	}
+	f.mu.Lock()
+	f.done = append(f.done, text)
+	f.mu.Unlock()
+	return []byte("<" + text + ">"), nil
+}
+
+func (f *fakeTTS) Encodings() []ttsEncoding { return ttsEncodings }
+
+// synthesizedChars is what google would have billed.
+func (f *fakeTTS) synthesizedChars() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, s := range f.done {
+		n += int64(utf8.RuneCountInString(s))
+	}
+	return n
+}
+
+func TestSpeechChunks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "short sentences ride along",
+			text: "Great. Now tell me how you would shard the users table across regions.",
+			want: []string{"Great. Now tell me how you would shard the users table across regions."},
+		},
+		{
+			name: "long sentences stand alone",
+			text: "The write path goes through a queue first of all. Then a worker picks every message up and stores it.",
+			want: []string{"The write path goes through a queue first of all.", "Then a worker picks every message up and stores it."},
+		},
+		{
+			name: "not across paragraphs",
+			text: "Okay.\n\nWhat about reads?",
+			want: []string{"Okay.", "What about reads?"},
+		},
+		{
+			name: "list items",
+			text: "- a queue\n- a log",
+			want: []string{"a queue", "a log"},
+		},
+		{name: "nothing to say", text: "**  **\n\n", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := speechChunks(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("chunks = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// five sentences of over minSpeechChunk runes each
+var streamSentences = []string{
+	"Sentence one is long enough to go out on its own.",
+	"Sentence two is long enough to go out on its own.",
+	"Sentence three is long enough to go out on its own.",
+	"Sentence four is long enough to go out on its own.",
+	"Sentence five is long enough to go out on its own.",
+}
+
+func ttsStreamRequest(t *testing.T, cfg *config, sessionID string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := `{"text":"` + strings.Join(streamSentences, " ") + `","sessionId":"` + sessionID + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/tts/stream", strings.NewReader(body))
+	r.Header.Set("Accept", "audio/mpeg")
+	w := httptest.NewRecorder()
+	cfg.ttsStreamHandler(w, r)
+	return w
+}
+
+func TestTTSStreamHandler(t *testing.T) {
+	clearUsage(t, "ip:192.0.2.1")
+	// later sentences finish first, the stream still has to come out in order
+	backwards := func(text string) time.Duration {
+		for i, s := range streamSentences {
+			if s == text {
+				return time.Duration(len(streamSentences)-i) * 5 * time.Millisecond
+			}
+		}
+		return 0
+	}
+
+	tests := []struct {
+		name        string
+		tts         *fakeTTS
+		parallelism int
+		wantCode    int
+		wantBody    string
+	}{
+		{
+			name:        "in order",
+			tts:         &fakeTTS{delay: backwards},
+			parallelism: 5,
+			wantCode:    http.StatusOK,
+			wantBody:    "<" + strings.Join(streamSentences, "><") + ">",
+		},
+		{
+			name:        "one at a time",
+			tts:         &fakeTTS{delay: backwards},
+			parallelism: 1,
+			wantCode:    http.StatusOK,
+			wantBody:    "<" + strings.Join(streamSentences, "><") + ">",
+		},
+		{
+			name:        "first sentence fails",
+			tts:         &fakeTTS{fail: "one"},
+			parallelism: 3,
+			wantCode:    http.StatusInternalServerError,
+		},
+		{
+			name:        "fails partway",
+			tts:         &fakeTTS{fail: "three"},
+			parallelism: 5,
+			wantCode:    http.StatusOK,
+			wantBody:    "<" + streamSentences[0] + "><" + streamSentences[1] + ">",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{tts: tt.tts, ttsBackend: "fake", ttsStreamParallelism: tt.parallelism}
+			session := addTestSession(t, &ChatSession{ID: "tts-stream-test", StartTime: time.Now(), IsActive: true})
+
+			w := ttsStreamRequest(t, cfg, session.ID)
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+			if tt.tts.maxRunning > tt.parallelism {
+				t.Errorf("%d sentences synthesized at once, the limit is %d", tt.tts.maxRunning, tt.parallelism)
+			}
+			// every sentence google made is counted, sent or not
+			if got, want := sessionUsage(session).TtsCharacters, tt.tts.synthesizedChars(); got != want {
+				t.Errorf("counted %d characters, %d were synthesized", got, want)
+			}
+		})
+	}
+}
+
+// cached sentences cost nothing and are not counted
+func TestTTSStreamHandlerCache(t *testing.T) {
+	clearUsage(t, "ip:192.0.2.1")
+	tts := &fakeTTS{}
+	cfg := &config{tts: tts, ttsBackend: "fake", ttsStreamParallelism: 2, ttsCache: newTTSCache(1<<20, "")}
+
+	first := addTestSession(t, &ChatSession{ID: "tts-stream-first", StartTime: time.Now(), IsActive: true})
+	ttsStreamRequest(t, cfg, first.ID)
+	second := addTestSession(t, &ChatSession{ID: "tts-stream-second", StartTime: time.Now(), IsActive: true})
+	w := ttsStreamRequest(t, cfg, second.ID)
+
+	if w.Body.String() != "<"+strings.Join(streamSentences, "><")+">" {
+		t.Errorf("body = %q", w.Body)
+	}
+	if len(tts.done) != len(streamSentences) {
+		t.Errorf("synthesized %d sentences, want each once", len(tts.done))
+	}
+	if sessionUsage(second).TtsCharacters != 0 {
+		t.Errorf("cached sentences were counted: %d", sessionUsage(second).TtsCharacters)
+	}
+}
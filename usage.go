@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// Usage is what a session or user spent on the paid APIs.
+type Usage struct {
+	PromptTokens    int64   `json:"promptTokens"`
+	OutputTokens    int64   `json:"outputTokens"`
+	TotalTokens     int64   `json:"totalTokens"`
+	SttAudioSeconds float64 `json:"sttAudioSeconds"`
+	TtsCharacters   int64   `json:"ttsCharacters"`
+}
+
+func (u *Usage) add(o Usage) {
+	u.PromptTokens += o.PromptTokens
+	u.OutputTokens += o.OutputTokens
+	u.TotalTokens += o.TotalTokens
+	u.SttAudioSeconds += o.SttAudioSeconds
+	u.TtsCharacters += o.TtsCharacters
+}
+
+func tokenUsage(m *genai.UsageMetadata) Usage {
+	if m == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens: int64(m.PromptTokenCount),
+		OutputTokens: int64(m.CandidatesTokenCount),
+		TotalTokens:  int64(m.TotalTokenCount),
+	}
+}
+
+// per user daily limits, 0 means unlimited
+type quotaConfig struct {
+	dailyTokens       int64
+	dailyAudioSeconds float64
+	dailyTtsChars     int64
+}
+
+type usageKey struct {
+	userID string
+	day    string
+}
+
+// usageMutex also guards ChatSession.Usage, so stt/tts calls dont have to wait on a running chat turn
+var (
+	dailyUsage = make(map[usageKey]*Usage)
+	usageMutex sync.Mutex
+)
+
+const usageRetentionDays = 31
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// recordUsage adds u to the user's daily total and, if there is one, to the session.
+func recordUsage(userID string, session *ChatSession, u Usage) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	key := usageKey{userID: userID, day: usageDay(time.Now())}
+	total, ok := dailyUsage[key]
+	if !ok {
+		total = &Usage{}
+		dailyUsage[key] = total
+		pruneUsage()
+	}
+	total.add(u)
+
+	if session != nil {
+		session.Usage.add(u)
+	}
+}
+
+// pruneUsage drops days past the retention window. callers hold usageMutex.
+func pruneUsage() {
+	cutoff := usageDay(time.Now().AddDate(0, 0, -usageRetentionDays))
+	for k := range dailyUsage {
+		if k.day < cutoff {
+			delete(dailyUsage, k)
+		}
+	}
+}
+
+func todaysUsage(userID string) Usage {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	if u, ok := dailyUsage[usageKey{userID: userID, day: usageDay(time.Now())}]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+func sessionUsage(session *ChatSession) Usage {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	return session.Usage
+}
+
+// the checks run before the call, so a user can go over by at most one request.
+// tts knows its cost upfront and is checked including the new text.
+
+func (q quotaConfig) tokensExceeded(userID string) bool {
+	return q.dailyTokens > 0 && todaysUsage(userID).TotalTokens >= q.dailyTokens
+}
+
+func (q quotaConfig) audioExceeded(userID string) bool {
+	return q.dailyAudioSeconds > 0 && todaysUsage(userID).SttAudioSeconds >= q.dailyAudioSeconds
+}
+
+func (q quotaConfig) ttsCharsExceeded(userID string, chars int64) bool {
+	return q.dailyTtsChars > 0 && todaysUsage(userID).TtsCharacters+chars > q.dailyTtsChars
+}
+
+var errQuotaExceeded = errors.New("daily usage quota exceeded")
+
+func respondQuotaExceeded(w http.ResponseWriter) {
+	errorsTotal.WithLabelValues(causeQuotaExceeded).Inc()
+	respondWithJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Daily usage quota exceeded"})
+}
+
+// set from TRUST_USER_ID_HEADER, only for deployments behind a proxy that authenticates
+// users and sets X-User-ID itself
+var trustUserIDHeader bool
+
+// userID identifies who is spending the quota and the rate limits. there is no auth yet and
+// X-User-ID is whatever the client sends, a new value per request would get a fresh quota,
+// so it is the client ip unless the header is trusted.
+func userID(r *http.Request) string {
+	if trustUserIDHeader {
+		if id := strings.TrimSpace(r.Header.Get("X-User-ID")); id != "" {
+			return id
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// set from TRUST_PROXY, only for deployments where a proxy like cloud run's front end sets
+// X-Forwarded-For. without one a client can send any address it likes in it
+var trustProxy bool
+
+func clientIP(r *http.Request) string {
+	// the last hop is the one the proxy added, anything before it is client supplied
+	if xff := r.Header.Get("X-Forwarded-For"); trustProxy && xff != "" {
+		hops := strings.Split(xff, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type UserUsage struct {
+	UserID string `json:"userId"`
+	Usage
+}
+
+type UsageReport struct {
+	Day      string      `json:"day"`
+	Total    Usage       `json:"total"`
+	Users    []UserUsage `json:"users"`
+	Sessions int         `json:"sessions"`
+	// tokens etc. of the sessions still held in memory, whatever day they ran on
+	SessionTotal Usage `json:"sessionTotal"`
+}
+
+func (cfg *config) usageHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.isAdmin(r) {
+		respondWithJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		day = usageDay(time.Now())
+	} else if _, err := time.Parse(time.DateOnly, day); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "'day' must be YYYY-MM-DD"})
+		return
+	}
+	filter := r.URL.Query().Get("userId")
+
+	report := UsageReport{Day: day, Users: []UserUsage{}}
+
+	sessionsMutex.RLock()
+	sessions := make([]*ChatSession, 0, len(chatSessions))
+	for _, s := range chatSessions {
+		if filter == "" || s.UserID == filter {
+			sessions = append(sessions, s)
+		}
+	}
+	sessionsMutex.RUnlock()
+
+	usageMutex.Lock()
+	for k, u := range dailyUsage {
+		if k.day != day || (filter != "" && k.userID != filter) {
+			continue
+		}
+		report.Users = append(report.Users, UserUsage{UserID: k.userID, Usage: *u})
+		report.Total.add(*u)
+	}
+	for _, s := range sessions {
+		report.SessionTotal.add(s.Usage)
+	}
+	usageMutex.Unlock()
+
+	report.Sessions = len(sessions)
+	slices.SortFunc(report.Users, func(a, b UserUsage) int {
+		return strings.Compare(a.UserID, b.UserID)
+	})
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// isAdmin checks the bearer token against ADMIN_TOKEN. without one configured the admin endpoints stay closed.
+func (cfg *config) isAdmin(r *http.Request) bool {
+	if cfg.adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminToken)) == 1
+}
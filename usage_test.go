@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// clearUsage forgets what the test recorded for these users.
+func clearUsage(t *testing.T, userIDs ...string) {
+	t.Cleanup(func() {
+		usageMutex.Lock()
+		defer usageMutex.Unlock()
+		for k := range dailyUsage {
+			for _, id := range userIDs {
+				if k.userID == id {
+					delete(dailyUsage, k)
+				}
+			}
+		}
+	})
+}
+
+func TestUserID(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted bool
+		proxy   bool
+		header  string
+		xff     string
+		want    string
+	}{
+		{name: "header ignored by default", header: "alice", want: "ip:192.0.2.1"},
+		{name: "a new header value is still the same user", header: "alice-2", want: "ip:192.0.2.1"},
+		{name: "forwarded ignored without a proxy", xff: "203.0.113.9", want: "ip:192.0.2.1"},
+		{name: "last forwarded hop behind a proxy", proxy: true, xff: "203.0.113.9, 198.51.100.7", want: "ip:198.51.100.7"},
+		{name: "behind a proxy without the header", proxy: true, want: "ip:192.0.2.1"},
+		{name: "trusted header", trusted: true, header: "alice", want: "alice"},
+		{name: "trusted but missing header", trusted: true, want: "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustUserIDHeader, trustProxy = tt.trusted, tt.proxy
+			defer func() { trustUserIDHeader, trustProxy = false, false }()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:5000"
+			if tt.header != "" {
+				r.Header.Set("X-User-ID", tt.header)
+			}
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := userID(r); got != tt.want {
+				t.Errorf("userID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	clearUsage(t, "usage-a", "usage-b")
+	session := &ChatSession{}
+
+	recordUsage("usage-a", session, Usage{PromptTokens: 10, OutputTokens: 5, TotalTokens: 15})
+	recordUsage("usage-a", nil, Usage{SttAudioSeconds: 30, TtsCharacters: 200})
+	recordUsage("usage-b", session, Usage{TotalTokens: 100})
+
+	if got, want := todaysUsage("usage-a"), (Usage{PromptTokens: 10, OutputTokens: 5, TotalTokens: 15, SttAudioSeconds: 30, TtsCharacters: 200}); got != want {
+		t.Errorf("usage-a today = %+v, want %+v", got, want)
+	}
+	if got := todaysUsage("usage-b").TotalTokens; got != 100 {
+		t.Errorf("usage-b tokens = %d, want 100", got)
+	}
+	// the session gets only what was recorded against it
+	if got, want := sessionUsage(session), (Usage{PromptTokens: 10, OutputTokens: 5, TotalTokens: 115}); got != want {
+		t.Errorf("session usage = %+v, want %+v", got, want)
+	}
+	if got := todaysUsage("usage-nobody"); got != (Usage{}) {
+		t.Errorf("unknown user = %+v, want nothing", got)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	clearUsage(t, "quota-user")
+	recordUsage("quota-user", nil, Usage{TotalTokens: 1000, SttAudioSeconds: 60, TtsCharacters: 900})
+
+	tests := []struct {
+		name  string
+		quota quotaConfig
+		check func(quotaConfig) bool
+		want  bool
+	}{
+		{name: "tokens unlimited", check: func(q quotaConfig) bool { return q.tokensExceeded("quota-user") }},
+		{name: "tokens under", quota: quotaConfig{dailyTokens: 1001}, check: func(q quotaConfig) bool { return q.tokensExceeded("quota-user") }},
+		{name: "tokens reached", quota: quotaConfig{dailyTokens: 1000}, check: func(q quotaConfig) bool { return q.tokensExceeded("quota-user") }, want: true},
+		{name: "tokens of someone else", quota: quotaConfig{dailyTokens: 1000}, check: func(q quotaConfig) bool { return q.tokensExceeded("quota-other") }},
+		{name: "audio under", quota: quotaConfig{dailyAudioSeconds: 61}, check: func(q quotaConfig) bool { return q.audioExceeded("quota-user") }},
+		{name: "audio reached", quota: quotaConfig{dailyAudioSeconds: 60}, check: func(q quotaConfig) bool { return q.audioExceeded("quota-user") }, want: true},
+		// tts counts the text about to be spoken
+		{name: "tts fits", quota: quotaConfig{dailyTtsChars: 1000}, check: func(q quotaConfig) bool { return q.ttsCharsExceeded("quota-user", 100) }},
+		{name: "tts would go over", quota: quotaConfig{dailyTtsChars: 1000}, check: func(q quotaConfig) bool { return q.ttsCharsExceeded("quota-user", 101) }, want: true},
+		{name: "tts unlimited", check: func(q quotaConfig) bool { return q.ttsCharsExceeded("quota-user", 1_000_000) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.check(tt.quota); got != tt.want {
+				t.Errorf("exceeded = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneUsage(t *testing.T) {
+	clearUsage(t, "prune-user")
+	old := usageKey{userID: "prune-user", day: usageDay(time.Now().AddDate(0, 0, -usageRetentionDays-1))}
+	kept := usageKey{userID: "prune-user", day: usageDay(time.Now().AddDate(0, 0, -1))}
+	usageMutex.Lock()
+	dailyUsage[old] = &Usage{TotalTokens: 1}
+	dailyUsage[kept] = &Usage{TotalTokens: 1}
+	pruneUsage()
+	_, oldOK := dailyUsage[old]
+	_, keptOK := dailyUsage[kept]
+	usageMutex.Unlock()
+
+	if oldOK || !keptOK {
+		t.Errorf("after pruning old = %v, yesterday = %v, want only yesterday", oldOK, keptOK)
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	clearUsage(t, "report-a", "report-b")
+	recordUsage("report-a", nil, Usage{TotalTokens: 10})
+	recordUsage("report-b", nil, Usage{TotalTokens: 20})
+	cfg := &config{adminToken: "secret"}
+
+	tests := []struct {
+		name      string
+		target    string
+		token     string
+		wantCode  int
+		wantUsers []string
+	}{
+		{name: "no token", target: "/admin/usage", wantCode: http.StatusUnauthorized},
+		{name: "wrong token", target: "/admin/usage", token: "guess", wantCode: http.StatusUnauthorized},
+		{name: "bad day", target: "/admin/usage?day=yesterday", token: "secret", wantCode: http.StatusBadRequest},
+		{name: "one user", target: "/admin/usage?userId=report-b", token: "secret", wantCode: http.StatusOK, wantUsers: []string{"report-b"}},
+		{name: "another day", target: "/admin/usage?day=2001-01-01&userId=report-a", token: "secret", wantCode: http.StatusOK, wantUsers: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			cfg.usageHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var report UsageReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Users) != len(tt.wantUsers) {
+				t.Fatalf("users = %+v, want %v", report.Users, tt.wantUsers)
+			}
+			for i, u := range report.Users {
+				if u.UserID != tt.wantUsers[i] {
+					t.Errorf("user %d = %q, want %q", i, u.UserID, tt.wantUsers[i])
+				}
+			}
+		})
+	}
+
+	// without ADMIN_TOKEN nobody gets in
+	r := httptest.NewRequest(http.MethodGet, "/admin/usage", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	(&config{}).usageHandler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no admin token configured: code = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/speech/apiv1p1beta1/speechpb"
+)
+
+// words the recognizer keeps turning into something else. boosted for every /stt request.
+var systemDesignGlossary = []string{
+	"Kafka", "RabbitMQ", "SQS", "Pub/Sub", "Kinesis",
+	"Cassandra", "DynamoDB", "MongoDB", "PostgreSQL", "MySQL", "Redis", "Memcached", "Elasticsearch", "HBase", "Bigtable", "Spanner", "CockroachDB",
+	"S3", "CDN", "CloudFront", "DNS", "TCP", "UDP", "HTTP", "gRPC", "REST", "GraphQL", "WebSocket", "WebSockets",
+	"sharding", "shard", "shards", "partitioning", "replication", "replica", "replicas", "leader election", "quorum",
+	"idempotent", "idempotency", "consistent hashing", "eventual consistency", "strong consistency", "linearizability",
+	"CAP theorem", "PACELC", "ACID", "BASE", "two-phase commit", "saga", "write-ahead log", "LSM tree", "B-tree",
+	"Bloom filter", "HyperLogLog", "Count-Min sketch", "geohash", "quadtree", "trie",
+	"load balancer", "reverse proxy", "API gateway", "rate limiter", "token bucket", "leaky bucket", "circuit breaker",
+	"cache aside", "write-through", "write-back", "TTL", "LRU", "cache invalidation", "cache stampede",
+	"p50", "p95", "p99", "QPS", "RPS", "TPS", "SLA", "SLO", "latency", "throughput",
+	"horizontal scaling", "vertical scaling", "autoscaling", "Kubernetes", "microservices", "monolith", "service mesh",
+	"fan-out", "fan-in", "backpressure", "dead letter queue", "exactly once", "at least once", "at most once",
+	"OAuth", "JWT", "TOTP", "OTP", "heartbeat", "gossip protocol", "Raft", "Paxos", "ZooKeeper", "etcd",
+	"MapReduce", "Spark", "Flink", "Hadoop", "HDFS", "OLTP", "OLAP", "data warehouse", "denormalization", "snowflake ID", "UUID",
+}
+
+const (
+	glossaryBoost = 10
+	// the session's own terms are likelier than the general ones
+	sessionTermsBoost = 15
+	maxSessionTerms   = 50
+)
+
+var (
+	// acronyms, CamelCase and mixed letter/digit tokens like S3, p99, DynamoDB
+	technicalToken = regexp.MustCompile(`\b(?:[A-Z]{2,}[a-z0-9]*|[A-Z][a-z]+[A-Z][A-Za-z0-9]*|[A-Za-z]+[0-9]+[A-Za-z0-9]*)\b`)
+	// runs of capitalized words, for names like "Apple Push Notification Service"
+	properNoun = regexp.MustCompile(`\b[A-Z][a-z]+(?:\s+[A-Z][a-z]+)*\b`)
+)
+
+var slugStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "how": true, "why": true, "what": true, "from": true,
+	"into": true, "our": true, "your": true, "that": true, "this": true, "html": true, "blog": true, "post": true,
+	"posts": true, "article": true, "engineering": true, "index": true, "www": true, "com": true,
+}
+
+// sessionVocabulary pulls the terms worth boosting out of the article urls, the concepts found in the
+// articles and the model's opening question.
+func sessionVocabulary(articleURLs, concepts []string, problemStatement string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	add := func(term string) {
+		term = strings.TrimSpace(term)
+		key := strings.ToLower(term)
+		if len(term) < 2 || len(term) > 100 || seen[key] || slugStopWords[key] {
+			return
+		}
+		seen[key] = true
+		terms = append(terms, term)
+	}
+
+	// picked out by the article analysis, the best guesses there are
+	for _, c := range concepts {
+		add(c)
+	}
+	for _, articleURL := range articleURLs {
+		u, err := url.Parse(articleURL)
+		if err != nil {
+			continue
+		}
+		// the company is usually in the host, the topic in the slug
+		host := strings.Split(strings.TrimPrefix(u.Hostname(), "www."), ".")
+		if len(host) > 0 {
+			add(host[0])
+		}
+		slug := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+		for _, word := range strings.FieldsFunc(slug, func(r rune) bool { return r == '-' || r == '_' }) {
+			if len(word) >= 4 && !isNumber(word) {
+				add(word)
+			}
+		}
+	}
+
+	for _, t := range technicalToken.FindAllString(problemStatement, -1) {
+		add(t)
+	}
+	for _, loc := range properNoun.FindAllStringIndex(problemStatement, -1) {
+		t := problemStatement[loc[0]:loc[1]]
+		// a single capitalized word only counts in the middle of a sentence
+		if strings.Contains(t, " ") || !startsSentence(problemStatement[:loc[0]]) {
+			add(t)
+		}
+	}
+
+	return terms[:min(len(terms), maxSessionTerms)]
+}
+
+func startsSentence(before string) bool {
+	before = strings.TrimRightFunc(before, unicode.IsSpace)
+	return before == "" || strings.ContainsAny(before[len(before)-1:], ".!?:\"'")
+}
+
+func isNumber(s string) bool {
+	return !strings.ContainsFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+}
+
+func speechContexts(sessionTerms []string) []*speechpb.SpeechContext {
+	contexts := []*speechpb.SpeechContext{{Phrases: slices.Clone(systemDesignGlossary), Boost: glossaryBoost}}
+	if len(sessionTerms) > 0 {
+		contexts = append(contexts, &speechpb.SpeechContext{Phrases: sessionTerms, Boost: sessionTermsBoost})
+	}
+	return contexts
+}
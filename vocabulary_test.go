@@ -0,0 +1,112 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSessionVocabulary(t *testing.T) {
+	tests := []struct {
+		name     string
+		urls     []string
+		concepts []string
+		problem  string
+		want     []string
+	}{
+		{name: "nothing", want: []string{}},
+		{name: "no problem", urls: []string{"https://eng.uber.com/schemaless"}, want: []string{"eng", "schemaless"}},
+		{
+			name:     "concepts first, the rest deduplicated whatever the case",
+			concepts: []string{"Kafka", "fan-out", "kafka"},
+			problem:  "Design a feed with KAFKA and Redis.",
+			want:     []string{"Kafka", "fan-out", "Redis"},
+		},
+		{
+			name: "host and slug",
+			urls: []string{"https://www.uber.com/blog/schemaless-part-one-2016/"},
+			want: []string{"uber", "schemaless", "part"},
+		},
+		{
+			name: "stop words and short slug words",
+			urls: []string{"https://engineering.fb.com/2020/how-the-news-feed-works.html"},
+			want: []string{"news", "feed", "works"},
+		},
+		{
+			name: "terms from several articles",
+			urls: []string{"https://discord.com/blog/how-discord-stores-messages", "https://www.uber.com/ringpop"},
+			want: []string{"discord", "stores", "messages", "uber", "ringpop"},
+		},
+		{name: "bad url", urls: []string{"://nope"}, want: []string{}},
+		{
+			name:    "technical tokens and names",
+			problem: "How would you build Apple Push Notification Service with DynamoDB, S3 and p99 under 100ms?",
+			want:    []string{"DynamoDB", "S3", "p99", "Apple Push Notification Service"},
+		},
+		{
+			name:    "a capitalized word starting a sentence is not a name",
+			problem: "Design a chat app. Messages go through Cassandra.",
+			want:    []string{"Cassandra"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sessionVocabulary(tt.urls, tt.concepts, tt.problem)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("terms = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionVocabularyLimits(t *testing.T) {
+	concepts := []string{"x", "  ", strings.Repeat("a", 101), strings.Repeat("b", 100), "  padded  "}
+	for i := range maxSessionTerms + 10 {
+		concepts = append(concepts, "term"+strconv.Itoa(i))
+	}
+	got := sessionVocabulary(nil, concepts, "")
+
+	if len(got) != maxSessionTerms {
+		t.Fatalf("got %d terms, want %d", len(got), maxSessionTerms)
+	}
+	if got[0] != strings.Repeat("b", 100) || got[1] != "padded" {
+		t.Errorf("first terms = %q, want the 100 rune one and the trimmed one", got[:2])
+	}
+	for _, term := range got {
+		if len(term) < 2 || len(term) > 100 {
+			t.Errorf("term %q is outside the phrase limits", term)
+		}
+	}
+}
+
+func TestSpeechContexts(t *testing.T) {
+	contexts := speechContexts(nil)
+	if len(contexts) != 1 || contexts[0].Boost != glossaryBoost || !slices.Equal(contexts[0].Phrases, systemDesignGlossary) {
+		t.Fatalf("without session terms want only the glossary, got %d contexts", len(contexts))
+	}
+	// the request gets a copy, the glossary stays as it is
+	contexts[0].Phrases[0] = "changed"
+	if systemDesignGlossary[0] == "changed" {
+		t.Fatal("speechContexts handed out the glossary itself")
+	}
+
+	contexts = speechContexts([]string{"Schemaless"})
+	if len(contexts) != 2 || contexts[1].Boost != sessionTermsBoost || !slices.Equal(contexts[1].Phrases, []string{"Schemaless"}) {
+		t.Errorf("session terms context = %+v", contexts[1:])
+	}
+}
+
+// google refuses phrases over 100 characters
+func TestGlossaryPhrases(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, p := range systemDesignGlossary {
+		if len(p) > 100 || strings.TrimSpace(p) != p || p == "" {
+			t.Errorf("bad glossary phrase %q", p)
+		}
+		if seen[p] {
+			t.Errorf("%q is in the glossary twice", p)
+		}
+		seen[p] = true
+	}
+}
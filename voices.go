@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	texttospeech "cloud.google.com/go/texttospeech/apiv1"
+	"cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+)
+
+// VoiceSettings is how the interviewer sounds. fields missing from the request fall back to the
+// session's settings, then the defaults.
+type VoiceSettings struct {
+	LanguageCode string `json:"languageCode,omitempty"`
+	Name         string `json:"name,omitempty"`
+	// 0.25 to 4, 1 is normal speed
+	SpeakingRate float64 `json:"speakingRate,omitempty"`
+	// semitones, -20 to 20
+	Pitch float64 `json:"pitch,omitempty"`
+
+	// whether the request had speakingRate and pitch, a pitch of 0 is a choice and not a missing field
+	rateSet, pitchSet bool
+}
+
+func (v *VoiceSettings) UnmarshalJSON(b []byte) error {
+	type plain VoiceSettings
+	var raw struct {
+		plain
+		SpeakingRate *float64 `json:"speakingRate"`
+		Pitch        *float64 `json:"pitch"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*v = VoiceSettings(raw.plain)
+	if raw.SpeakingRate != nil {
+		v.SpeakingRate, v.rateSet = *raw.SpeakingRate, true
+	}
+	if raw.Pitch != nil {
+		v.Pitch, v.pitchSet = *raw.Pitch, true
+	}
+	return nil
+}
+
+// languageCodePattern is the part of BCP-47 google uses: en, en-US, cmn-Hant-TW
+var languageCodePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8}){0,2}$`)
+
+var defaultVoice = VoiceSettings{
+	LanguageCode: "en-US",
+	Name:         "en-US-Wavenet-F",
+	SpeakingRate: 1,
+}
+
+// merge fills the fields v did not set from fallback.
+func (v VoiceSettings) merge(fallback VoiceSettings) VoiceSettings {
+	if v.LanguageCode == "" && v.Name == "" {
+		v.LanguageCode, v.Name = fallback.LanguageCode, fallback.Name
+	}
+	if !v.rateSet {
+		v.SpeakingRate = fallback.SpeakingRate
+	}
+	if !v.pitchSet {
+		v.Pitch = fallback.Pitch
+	}
+	v.rateSet, v.pitchSet = true, true
+	return v
+}
+
+func (v VoiceSettings) validate() error {
+	if v.rateSet && (v.SpeakingRate < 0.25 || v.SpeakingRate > 4) {
+		return fmt.Errorf("speakingRate must be between 0.25 and 4")
+	}
+	if v.LanguageCode != "" && !languageCodePattern.MatchString(v.LanguageCode) {
+		return fmt.Errorf("languageCode must look like en or en-US")
+	}
+	if v.Pitch < -20 || v.Pitch > 20 {
+		return fmt.Errorf("pitch must be between -20 and 20")
+	}
+	// voice names start with their language, en-GB-Neural2-A. language codes arent case sensitive so en-gb is fine too
+	if v.Name != "" && v.LanguageCode != "" && (len(v.Name) < len(v.LanguageCode) || !strings.EqualFold(v.Name[:len(v.LanguageCode)], v.LanguageCode)) {
+		return fmt.Errorf("voice %s is not a %s voice", v.Name, v.LanguageCode)
+	}
+	return nil
+}
+
+func (v VoiceSettings) selectionParams() *texttospeechpb.VoiceSelectionParams {
+	lang := v.LanguageCode
+	if lang == "" && v.Name != "" {
+		// the name alone is enough to pick the voice but the api still wants the language
+		parts := strings.SplitN(v.Name, "-", 3)
+		lang = strings.Join(parts[:min(len(parts), 2)], "-")
+	}
+	return &texttospeechpb.VoiceSelectionParams{LanguageCode: lang, Name: v.Name}
+}
+
+// ttsEncoding is an output format the client can ask for through Accept.
+type ttsEncoding struct {
+	contentType string
+	encoding    texttospeechpb.AudioEncoding
+	// file extension in the tts disk cache
+	ext string
+}
+
+// first one is the default for clients that accept anything
+var ttsEncodings = []ttsEncoding{
+	{contentType: "audio/mpeg", encoding: texttospeechpb.AudioEncoding_MP3, ext: ".mp3"},
+	{contentType: "audio/ogg", encoding: texttospeechpb.AudioEncoding_OGG_OPUS, ext: ".ogg"},
+	// LINEAR16 comes back with a wav header
+	{contentType: "audio/wav", encoding: texttospeechpb.AudioEncoding_LINEAR16, ext: ".wav"},
+}
+
+var encodingAliases = map[string]string{
+	"audio/mp3":   "audio/mpeg",
+	"audio/opus":  "audio/ogg",
+	"audio/x-wav": "audio/wav",
+	"audio/wave":  "audio/wav",
+}
+
+// negotiateEncoding picks one of supported for an Accept header, highest q first. false means none of them is acceptable.
+func negotiateEncoding(accept string, supported []ttsEncoding) (ttsEncoding, bool) {
+	if len(supported) == 0 {
+		return ttsEncoding{}, false
+	}
+	if strings.TrimSpace(accept) == "" {
+		return supported[0], true
+	}
+
+	type option struct {
+		mediaType string
+		q         float64
+	}
+	var options []option
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if alias, ok := encodingAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		options = append(options, option{mediaType: mediaType, q: q})
+	}
+	// stable, so equal q keeps the client's order
+	slices.SortStableFunc(options, func(a, b option) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+
+	for _, o := range options {
+		if o.q <= 0 {
+			continue
+		}
+		if o.mediaType == "*/*" || o.mediaType == "audio/*" {
+			return supported[0], true
+		}
+		for _, e := range supported {
+			if e.contentType == o.mediaType {
+				return e, true
+			}
+		}
+	}
+	return ttsEncoding{}, false
+}
+
+// onlyEncodings keeps the encodings in offered that are also in allowed, in offered's order.
+func onlyEncodings(offered, allowed []ttsEncoding) []ttsEncoding {
+	var out []ttsEncoding
+	for _, e := range offered {
+		if slices.Contains(allowed, e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// notAcceptable is the 406 for an Accept header none of supported matches.
+func notAcceptable(w http.ResponseWriter, supported []ttsEncoding) {
+	types := make([]string, len(supported))
+	for i, e := range supported {
+		types[i] = e.contentType
+	}
+	respondWithJSON(w, http.StatusNotAcceptable, map[string]string{"error": "Supported audio types are " + strings.Join(types, ", ")})
+}
+
+// Voice is one entry of GET /voices.
+type Voice struct {
+	Name              string   `json:"name"`
+	LanguageCodes     []string `json:"languageCodes"`
+	Gender            string   `json:"gender"`
+	NaturalSampleRate int32    `json:"naturalSampleRate"`
+}
+
+const (
+	voicesCacheTTL = time.Hour
+	// one entry per language asked for, there are not many more than this
+	maxVoicesCacheEntries = 100
+)
+
+type voicesCacheEntry struct {
+	voices  []Voice
+	fetched time.Time
+}
+
+// the voice list barely changes, no need to ask google on every page load
+var (
+	voicesCache      = make(map[string]voicesCacheEntry)
+	voicesCacheMutex sync.Mutex
+)
+
+// voiceLister is implemented by the tts backends that can tell which voices they have.
+type voiceLister interface {
+	Voices(ctx context.Context, languageCode string) ([]Voice, error)
+}
+
+func (googleTextToSpeech) Voices(ctx context.Context, languageCode string) ([]Voice, error) {
+	voicesCacheMutex.Lock()
+	entry, ok := voicesCache[languageCode]
+	voicesCacheMutex.Unlock()
+	if ok && time.Since(entry.fetched) < voicesCacheTTL {
+		return entry.voices, nil
+	}
+
+	client, err := texttospeech.NewClient(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create text-to-speech client", "error", err)
+		return nil, fmt.Errorf("failed to create tts client")
+	}
+	defer client.Close()
+
+	resp, err := client.ListVoices(ctx, &texttospeechpb.ListVoicesRequest{LanguageCode: languageCode})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list voices", "error", err)
+		return nil, fmt.Errorf("failed to list voices")
+	}
+
+	voices := make([]Voice, 0, len(resp.Voices))
+	for _, v := range resp.Voices {
+		voices = append(voices, Voice{
+			Name:              v.Name,
+			LanguageCodes:     v.LanguageCodes,
+			Gender:            strings.ToLower(v.SsmlGender.String()),
+			NaturalSampleRate: v.NaturalSampleRateHertz,
+		})
+	}
+	slices.SortFunc(voices, func(a, b Voice) int { return strings.Compare(a.Name, b.Name) })
+
+	voicesCacheMutex.Lock()
+	if len(voicesCache) >= maxVoicesCacheEntries {
+		pruneVoicesCache()
+	}
+	voicesCache[languageCode] = voicesCacheEntry{voices: voices, fetched: time.Now()}
+	voicesCacheMutex.Unlock()
+
+	return voices, nil
+}
+
+// pruneVoicesCache drops the expired entries, and the oldest one if none were. callers hold voicesCacheMutex.
+func pruneVoicesCache() {
+	oldestCode, oldest := "", time.Time{}
+	for code, entry := range voicesCache {
+		if time.Since(entry.fetched) >= voicesCacheTTL {
+			delete(voicesCache, code)
+		} else if oldestCode == "" || entry.fetched.Before(oldest) {
+			oldestCode, oldest = code, entry.fetched
+		}
+	}
+	if len(voicesCache) >= maxVoicesCacheEntries {
+		delete(voicesCache, oldestCode)
+	}
+}
+
+func (cfg *config) voicesHandler(w http.ResponseWriter, r *http.Request) {
+	// all the english accents unless asked for something else
+	languageCode := r.URL.Query().Get("languageCode")
+	if languageCode == "" {
+		languageCode = "en"
+	}
+	// every new value would be a call to google and a cache entry
+	if !languageCodePattern.MatchString(languageCode) {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "'languageCode' must look like en or en-US"})
+		return
+	}
+	// google does not care about case, the cache should not either
+	languageCode = strings.ToLower(languageCode)
+
+	lister, ok := cfg.tts.(voiceLister)
+	if !ok {
+		// the local engines speak with whatever voice they were started with
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"defaultVoice": defaultVoice,
+			"voices":       []Voice{},
+		})
+		return
+	}
+	voices, err := lister.Voices(r.Context(), languageCode)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list voices"})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"defaultVoice": defaultVoice,
+		"voices":       voices,
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVoiceSettingsMerge(t *testing.T) {
+	session := VoiceSettings{LanguageCode: "en-GB", Name: "en-GB-Neural2-A", SpeakingRate: 1.2, Pitch: 4}
+	tests := []struct {
+		name    string
+		request string
+		want    VoiceSettings
+	}{
+		{name: "nothing set keeps the session's voice", request: `{}`, want: session},
+		{name: "pitch back to 0", request: `{"pitch":0}`, want: VoiceSettings{LanguageCode: "en-GB", Name: "en-GB-Neural2-A", SpeakingRate: 1.2, Pitch: 0}},
+		{name: "rate only", request: `{"speakingRate":0.8}`, want: VoiceSettings{LanguageCode: "en-GB", Name: "en-GB-Neural2-A", SpeakingRate: 0.8, Pitch: 4}},
+		{name: "other voice", request: `{"languageCode":"en-US","name":"en-US-Wavenet-D"}`, want: VoiceSettings{LanguageCode: "en-US", Name: "en-US-Wavenet-D", SpeakingRate: 1.2, Pitch: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req VoiceSettings
+			if err := json.Unmarshal([]byte(tt.request), &req); err != nil {
+				t.Fatal(err)
+			}
+			got := req.merge(session)
+			if got.LanguageCode != tt.want.LanguageCode || got.Name != tt.want.Name || got.SpeakingRate != tt.want.SpeakingRate || got.Pitch != tt.want.Pitch {
+				t.Errorf("merge = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVoiceSettingsValidate(t *testing.T) {
+	tests := []struct {
+		request string
+		wantErr bool
+	}{
+		{request: `{}`},
+		{request: `{"pitch":0,"speakingRate":1}`},
+		{request: `{"pitch":-20,"speakingRate":4}`},
+		{request: `{"speakingRate":0}`, wantErr: true},
+		{request: `{"speakingRate":4.5}`, wantErr: true},
+		{request: `{"pitch":21}`, wantErr: true},
+		{request: `{"languageCode":"en-GB","name":"en-GB-Neural2-A"}`},
+		{request: `{"languageCode":"en-GB","name":"en-US-Neural2-A"}`, wantErr: true},
+		{request: `{"languageCode":"en-gb","name":"en-GB-Neural2-A"}`},
+		{request: `{"languageCode":"EN","name":"en-GB-Neural2-A"}`},
+		{request: `{"languageCode":"en-GB","name":"en"}`, wantErr: true},
+		{request: `{"languageCode":"en_GB; drop"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var v VoiceSettings
+		if err := json.Unmarshal([]byte(tt.request), &v); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%s) = %v, want error %v", tt.request, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVoicesHandlerRejectsBadLanguageCodes(t *testing.T) {
+	cfg := &config{tts: googleTextToSpeech{}}
+	for _, code := range []string{"x", "english-please-now-thanks", "en%20US", "../../etc"} {
+		w := httptest.NewRecorder()
+		cfg.voicesHandler(w, httptest.NewRequest(http.MethodGet, "/voices?languageCode="+code, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("languageCode %q: code = %d, want 400", code, w.Code)
+		}
+	}
+}
+
+func TestPruneVoicesCache(t *testing.T) {
+	voicesCacheMutex.Lock()
+	defer voicesCacheMutex.Unlock()
+	saved := voicesCache
+	defer func() { voicesCache = saved }()
+
+	voicesCache = make(map[string]voicesCacheEntry)
+	now := time.Now()
+	for i := range maxVoicesCacheEntries {
+		voicesCache[string(rune('a'+i%26))+string(rune('a'+i/26))] = voicesCacheEntry{fetched: now.Add(time.Duration(i) * time.Second)}
+	}
+	pruneVoicesCache()
+	if len(voicesCache) != maxVoicesCacheEntries-1 {
+		t.Fatalf("%d entries after pruning, want %d", len(voicesCache), maxVoicesCacheEntries-1)
+	}
+	if _, ok := voicesCache["aa"]; ok {
+		t.Error("oldest entry was kept")
+	}
+
+	voicesCache["old"] = voicesCacheEntry{fetched: now.Add(-2 * voicesCacheTTL)}
+	pruneVoicesCache()
+	if _, ok := voicesCache["old"]; ok {
+		t.Error("expired entry was kept")
+	}
+}